@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/mwek/psflip/pkg/figs"
+	"github.com/mwek/psflip/pkg/healthcheck"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// checkCommand implements `psflip check`: it loads the configuration for both AB flag values, validates it and
+// prints the rendered configuration, returning the exit code.
+func checkCommand(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	path := fs.StringP("config", "c", "config.yml", "psflip configuration file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s check [OPTIONS...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Validate the configuration and print it rendered for both AB flag values.")
+		fmt.Fprintln(fs.Output(), "")
+		fmt.Fprintln(fs.Output(), "Available options:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	ec := 0
+	for i, ab := range figs.ABFlags() {
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Printf("# AB flag: %s\n", ab)
+		figs.SetAB(ab)
+		c, err := checkConfig(*path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "AB flag %s: %v\n", ab, err)
+			ec = 1
+			continue
+		}
+		out, err := yaml.Marshal(&c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "AB flag %s: %v\n", ab, err)
+			ec = 1
+			continue
+		}
+		os.Stdout.Write(out)
+	}
+	return ec
+}
+
+// checkConfig loads the configuration like psflip does, and checks what otherwise fails only when starting the child.
+func checkConfig(path string) (Config, error) {
+	c, err := loadConfig(path)
+	if err != nil {
+		return c, err
+	}
+	var errs []error
+	if _, err := healthcheck.New(c.Healthcheck); err != nil {
+		errs = append(errs, fmt.Errorf("invalid healthcheck: %w", err))
+	}
+	if _, err := exec.LookPath(c.Cmd[0].String()); err != nil {
+		errs = append(errs, fmt.Errorf("invalid cmd: %w", err))
+	}
+	hooks := []struct {
+		name string
+		hook *HookConfig
+	}{
+		{"preStart", c.Hooks.PreStart},
+		{"postReady", c.Hooks.PostReady},
+		{"preStop", c.Hooks.PreStop},
+		{"postStop", c.Hooks.PostStop},
+	}
+	for _, h := range hooks {
+		if h.hook == nil {
+			continue
+		}
+		if _, err := exec.LookPath(h.hook.Cmd[0].String()); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s hook: %w", h.name, err))
+		}
+	}
+	if dir := c.WorkDir.String(); dir != "" {
+		if !filepath.IsAbs(dir) {
+			wd, _ := os.Getwd()
+			dir = filepath.Join(wd, dir)
+		}
+		fi, err := os.Stat(dir)
+		if err == nil && !fi.IsDir() {
+			err = fmt.Errorf("%s is not a directory", dir)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid workdir: %w", err))
+		}
+	}
+	return c, errors.Join(errs...)
+}
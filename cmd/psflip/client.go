@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"golang.org/x/sys/unix"
+)
+
+// pollInterval of the pidfile when waiting for the upgrade without the control socket.
+const pollInterval = 100 * time.Millisecond
+
+// upgradeCommand implements `psflip upgrade`: it upgrades the running psflip through the control socket, or by
+// signalling the PID in the pidfile, and returns the exit code.
+func upgradeCommand(args []string) int {
+	fs := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	path := fs.StringP("config", "c", "config.yml", "psflip configuration file")
+	wait := fs.Bool("wait", false, "wait until the upgrade succeeds or fails")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s upgrade [OPTIONS...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Upgrade the running psflip.")
+		fmt.Fprintln(fs.Output(), "")
+		fmt.Fprintln(fs.Output(), "Available options:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if c.Control != "" {
+		err = upgradeControl(c.Control.String(), *wait)
+	} else {
+		err = upgradePidfile(&c, *wait)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "upgrade failed: %v\n", err)
+		return 1
+	}
+	if *wait {
+		fmt.Println("upgrade succeeded")
+	}
+	return 0
+}
+
+// upgradeControl sends the upgrade command to the control socket, reading the result if waiting.
+func upgradeControl(path string, wait bool) error {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("upgrade\n")); err != nil {
+		return err
+	}
+	if !wait {
+		return nil
+	}
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("no reply from psflip: %w", err)
+	}
+	var r reply
+	if err := json.Unmarshal(line, &r); err != nil {
+		return err
+	}
+	if !r.OK {
+		return errors.New(r.Error)
+	}
+	return nil
+}
+
+// upgradePidfile sends the upgrade signal to the PID in the pidfile. When waiting, the upgrade succeeds once the
+// pidfile holds a new running PID; the reason of a failure is only logged by psflip.
+func upgradePidfile(c *Config, wait bool) error {
+	if c.Pidfile == "" {
+		return errors.New("neither control nor pidfile configured")
+	}
+	pid, err := readPid(c.Pidfile.String())
+	if err != nil {
+		return err
+	}
+	if err := unix.Kill(pid, c.Upgrade.Signal.Syscall()); err != nil {
+		return fmt.Errorf("failed to signal psflip %d: %w", pid, err)
+	}
+	if !wait {
+		return nil
+	}
+
+	timeout := c.upgradeBudget() + 5*time.Second
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(pollInterval)
+		if newPid, err := readPid(c.Pidfile.String()); err == nil && newPid != pid && unix.Kill(newPid, 0) == nil {
+			return nil
+		}
+		if unix.Kill(pid, 0) != nil {
+			return fmt.Errorf("psflip %d exited", pid)
+		}
+	}
+	return fmt.Errorf("no new psflip after %s, see the psflip logs", timeout)
+}
+
+func readPid(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pidfile %s", path)
+	}
+	return pid, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/tableflip"
+	"github.com/mwek/psflip/pkg/figs"
+	"github.com/mwek/psflip/pkg/metrics"
+)
+
+// generationEnv counts the psflip upgrades since the first start.
+const generationEnv = "PSFLIP_GENERATION"
+
+var (
+	// generation of this psflip, the first started one being 1
+	generation int
+	// started is when this psflip started
+	started = time.Now()
+)
+
+func init() {
+	generation, _ = strconv.Atoi(os.Getenv(generationEnv))
+	generation++
+	os.Setenv(generationEnv, strconv.Itoa(generation))
+}
+
+// psflipEnv describes this psflip to the child and the hooks. The environment inherited by them may hold the values
+// of the previous psflip, or the ones set for the upgraded psflip.
+func psflipEnv() []string {
+	return []string{
+		generationEnv + "=" + strconv.Itoa(generation),
+		figs.ABEnv(),
+		upgradeStartEnv + "=" + upgradeStart,
+	}
+}
+
+// States of psflip reported by the status command.
+const (
+	stateStarting  = "starting"
+	stateRunning   = "running"
+	stateUpgrading = "upgrading"
+	stateUpgraded  = "upgraded"
+	stateStopping  = "stopping"
+)
+
+// controlTimeout limits reading the command from the control socket.
+const controlTimeout = 5 * time.Second
+
+// control serves the commands of the control socket, and tracks the state reported by the status command.
+type control struct {
+	sv       *supervisor
+	children *net.UnixConn
+	// upgrades requests the upgrade, replying with its result
+	upgrades chan chan<- error
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex
+	state  string
+	newPid int
+	// start of the upgrade
+	start time.Time
+	// reason and cause of the failure reported by the new psflip, and its journal entry
+	reason string
+	cause  string
+	entry  *journalEntry
+	// reported is closed once the new psflip reports the outcome
+	reported chan struct{}
+	last     *upgradeResult
+	// done is closed once upgraded to the new psflip
+	done chan struct{}
+	// handedOff is the snapshot of the metrics already handed off to the new psflip
+	handedOff metrics.Snapshot
+}
+
+// upgradeResult describes the last upgrade attempt.
+type upgradeResult struct {
+	Time  time.Time `json:"time"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+}
+
+// status is the reply to the status command.
+type status struct {
+	Pid         int            `json:"pid"`
+	ChildPid    int            `json:"childPid,omitempty"`
+	Generation  int            `json:"generation"`
+	State       string         `json:"state"`
+	Uptime      string         `json:"uptime"`
+	LastUpgrade *upgradeResult `json:"lastUpgrade,omitempty"`
+}
+
+// reply is written back for every command.
+type reply struct {
+	OK     bool    `json:"ok"`
+	Error  string  `json:"error,omitempty"`
+	Status *status `json:"status,omitempty"`
+}
+
+func newControl(sv *supervisor) *control {
+	return &control{
+		sv:       sv,
+		upgrades: make(chan chan<- error),
+		stop:     make(chan struct{}),
+		state:    stateStarting,
+		done:     make(chan struct{}),
+	}
+}
+
+// Upgraded is closed when the upgrade to the new psflip succeeds.
+func (ctl *control) Upgraded() <-chan struct{} {
+	return ctl.done
+}
+
+// Stop is closed when the stop command is received.
+func (ctl *control) Stop() <-chan struct{} {
+	return ctl.stop
+}
+
+func (ctl *control) setState(state string) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	ctl.state = state
+}
+
+// upgrading records the start of the upgrade, returning its time.
+func (ctl *control) upgrading() time.Time {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	ctl.state = stateUpgrading
+	ctl.start = time.Now()
+	ctl.newPid = 0
+	mUpgradeAttempts.Inc()
+	ctl.reason, ctl.cause, ctl.entry = "", "", nil
+	ctl.reported = make(chan struct{})
+	return ctl.start
+}
+
+// started records the PID of the new psflip.
+func (ctl *control) started(pid int) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if ctl.state == stateUpgrading {
+		ctl.newPid = pid
+	}
+}
+
+// failed records why the new psflip gives up the upgrade.
+func (ctl *control) failed(pid int, reason, cause string) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if ctl.state == stateUpgrading && (ctl.newPid == 0 || ctl.newPid == pid) {
+		ctl.reason, ctl.cause = reason, cause
+	}
+}
+
+// outcome records the outcome reported by the new psflip: why it gave up the upgrade, and its journal entry.
+func (ctl *control) outcome(m message) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if ctl.state != stateUpgrading || (ctl.newPid != 0 && ctl.newPid != m.Pid) {
+		return
+	}
+	if m.Error != "" {
+		ctl.reason, ctl.cause = m.Reason, m.Error
+	}
+	if m.Journal != nil {
+		ctl.entry = m.Journal
+	}
+	select {
+	case <-ctl.reported:
+	default:
+		close(ctl.reported)
+	}
+}
+
+// awaitReport waits up to the timeout for the new psflip to report the outcome, which may arrive after the
+// upgrader returns.
+func (ctl *control) awaitReport(timeout time.Duration) {
+	ctl.mu.Lock()
+	reported := ctl.reported
+	ctl.mu.Unlock()
+	select {
+	case <-reported:
+	case <-time.After(timeout):
+	}
+}
+
+// upgraded records the final result of the upgrade in the journal, returning the error with the cause reported by
+// the new psflip.
+func (ctl *control) upgraded(err error) error {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	reason := failureReason(err)
+	if err != nil && ctl.cause != "" {
+		reason = ctl.reason
+		err = failed(reason, fmt.Errorf("%s (%w)", ctl.cause, err))
+	}
+	ctl.last = &upgradeResult{Time: time.Now(), OK: err == nil}
+	journalUpgrade(ctl.start, ctl.newPid, ctl.entry, err)
+	if err != nil {
+		ctl.last.Error = err.Error()
+		ctl.state = stateRunning
+		mUpgrades.Inc("failed")
+		mUpgradeFailures.Inc(reason)
+	} else {
+		ctl.state = stateUpgraded
+		mUpgrades.Inc("succeeded")
+		close(ctl.done)
+	}
+	return err
+}
+
+// handoff sends the metrics to the new psflip after the upgrade, which keeps exposing them. The first call hands
+// off all the metrics, the next ones only their increase since.
+func (ctl *control) handoff() {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if ctl.state != stateUpgraded || ctl.children == nil {
+		return
+	}
+	snap := registry.Snapshot()
+	delta := snap.Sub(ctl.handedOff)
+	if ctl.handedOff != nil && len(delta) == 0 {
+		return
+	}
+	if err := send(ctl.children, message{Metrics: delta}); err != nil {
+		slog.Error("metrics.handoff_failed", "err", err)
+		return
+	}
+	ctl.handedOff = snap
+}
+
+// listenControl returns the control socket listener, inheriting it from the previous psflip. It changes the umask
+// of the process meanwhile, so it must be called before anything is forked.
+func listenControl(upg *tableflip.Upgrader, path string) (net.Listener, error) {
+	return upg.ListenWithCallback("unix", path, func(network, address string) (net.Listener, error) {
+		removeStale(network, address)
+		// The commands are not authenticated: create the socket accessible to the owner only
+		mask := syscall.Umask(0177)
+		defer syscall.Umask(mask)
+		return net.Listen(network, address)
+	})
+}
+
+// serve accepts the control connections until the listener is closed.
+func (ctl *control) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go ctl.handle(c)
+	}
+}
+
+// handle executes a single command per connection: status, upgrade, abort or stop.
+func (ctl *control) handle(c net.Conn) {
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	r := reply{OK: true}
+	switch cmd := strings.TrimSpace(line); cmd {
+	case "status":
+		r.Status = ctl.status()
+	case "upgrade":
+		err = ctl.upgrade()
+	case "abort":
+		err = ctl.abort()
+	case "stop":
+		ctl.setState(stateStopping)
+		ctl.stopOnce.Do(func() { close(ctl.stop) })
+	default:
+		err = fmt.Errorf("unknown command: %q", cmd)
+	}
+	if err != nil {
+		r = reply{Error: err.Error()}
+	}
+	json.NewEncoder(c).Encode(r)
+}
+
+func (ctl *control) status() *status {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	return &status{
+		Pid:         os.Getpid(),
+		ChildPid:    ctl.sv.ChildPid(),
+		Generation:  generation,
+		State:       ctl.state,
+		Uptime:      time.Since(started).Round(time.Second).String(),
+		LastUpgrade: ctl.last,
+	}
+}
+
+// upgrade runs the upgrade, waiting for its result.
+func (ctl *control) upgrade() error {
+	result := make(chan error, 1)
+	select {
+	case ctl.upgrades <- result:
+	case <-ctl.stop:
+		return errors.New("psflip is stopping")
+	}
+	return <-result
+}
+
+// abort asks the new psflip of the upgrade in progress to exit.
+func (ctl *control) abort() error {
+	ctl.mu.Lock()
+	state, pid := ctl.state, ctl.newPid
+	ctl.mu.Unlock()
+	switch {
+	case state != stateUpgrading:
+		return errors.New("no upgrade in progress")
+	case pid == 0:
+		return errors.New("new psflip did not start yet")
+	}
+	slog.Info("upgrade.aborting", "pid", pid)
+	ctl.failed(pid, failAborted, "upgrade aborted")
+	return send(ctl.children, message{Abort: true, To: pid})
+}
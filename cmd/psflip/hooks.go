@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/mwek/psflip/pkg/figs"
+	"github.com/mwek/psflip/pkg/process"
+)
+
+// hook runs the command of the hook (if configured) until it exits. The command receives the name of the hook in
+// PSFLIP_HOOK, and the extra environment.
+func (sv *supervisor) hook(name string, h *HookConfig, env ...string) error {
+	if h == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	args := figs.Stringify(h.Cmd)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = sv.WorkDir.String()
+	cmd.Env = append(append(os.Environ(), psflipEnv()...), figs.Stringify(sv.Env)...)
+	cmd.Env = append(cmd.Env, "PSFLIP_HOOK="+name)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.SysProcAttr = process.SysAttr()
+
+	start := time.Now()
+	slog.Info("hook.started", "hook", name)
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("did not finish in %s", h.Timeout)
+	}
+	if err != nil {
+		slog.Error("hook.failed", "hook", name, "err", err)
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	slog.Info("hook.finished", "hook", name, "duration", time.Since(start))
+	return nil
+}
+
+// startHooksTimeout is the longest time the hooks may delay psflip becoming ready.
+func (c *Config) startHooksTimeout() time.Duration {
+	var d time.Duration
+	for _, h := range []*HookConfig{c.Hooks.PreStart, c.Hooks.PostReady} {
+		if h != nil {
+			d += h.Timeout
+		}
+	}
+	return d
+}
+
+// childEnv describes the child to the hooks.
+func childEnv(child *process.Process) string {
+	return fmt.Sprintf("PSFLIP_CHILD_PID=%d", child.Pid)
+}
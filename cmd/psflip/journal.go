@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/cloudflare/tableflip"
+	"github.com/mwek/psflip/pkg/figs"
+)
+
+// upgradeStartEnv passes the time the upgrade started to the new psflip.
+const upgradeStartEnv = "PSFLIP_UPGRADE_START"
+
+// upgradeStart is when the upgrade to this psflip started, empty if it was not upgraded.
+var upgradeStart = os.Getenv(upgradeStartEnv)
+
+// journalEntry records a single upgrade attempt.
+type journalEntry struct {
+	// Time the upgrade started
+	Time time.Time `json:"time"`
+	// OldPid and NewPid of psflip, and ChildPid of the new child
+	OldPid   int `json:"oldPid"`
+	NewPid   int `json:"newPid,omitempty"`
+	ChildPid int `json:"childPid,omitempty"`
+	// Generation and ABFlag of the new psflip
+	Generation int    `json:"generation"`
+	ABFlag     string `json:"abFlag"`
+	// ConfigHash and BinaryHash are the SHA-256 of the configuration file and the psflip executable
+	ConfigHash string `json:"configHash,omitempty"`
+	BinaryHash string `json:"binaryHash,omitempty"`
+	// Outcome is "succeeded" or "failed", with the reason and the error of the failure
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Phases are the durations of the upgrade phases, in seconds
+	Phases map[string]float64 `json:"phases"`
+}
+
+// journal tracks the upgrade to this psflip until it is handed to the parent, which records it once the outcome
+// is final.
+type journal struct {
+	entry journalEntry
+	mark  time.Time
+	done  bool
+}
+
+// startJournal begins the entry of the upgrade to this psflip. It returns nil if psflip was not upgraded.
+func startJournal(upg *tableflip.Upgrader) *journal {
+	if !upg.HasParent() {
+		return nil
+	}
+	start, err := time.Parse(time.RFC3339Nano, upgradeStart)
+	if err != nil {
+		start = started
+	}
+	j := &journal{entry: newJournalEntry(start, os.Getppid()), mark: started}
+	j.entry.NewPid = os.Getpid()
+	j.entry.Generation = generation
+	j.entry.Phases["spawn"] = started.Sub(start).Seconds()
+	return j
+}
+
+// newJournalEntry describes the upgrade to the current configuration file and executable.
+func newJournalEntry(start time.Time, oldPid int) journalEntry {
+	e := journalEntry{
+		Time:       start,
+		OldPid:     oldPid,
+		ABFlag:     figs.ABFlag(),
+		ConfigHash: hashFile(*fConfig),
+		Phases:     make(map[string]float64),
+	}
+	if exe, err := os.Executable(); err == nil {
+		e.BinaryHash = hashFile(exe)
+	}
+	return e
+}
+
+// phase records the duration since the previous phase.
+func (j *journal) phase(name string) {
+	if j == nil {
+		return
+	}
+	now := time.Now()
+	j.entry.Phases[name] = now.Sub(j.mark).Seconds()
+	j.mark = now
+}
+
+// finish returns the entry with the child PID to hand to the parent, once.
+func (j *journal) finish(childPid int) *journalEntry {
+	if j == nil || j.done {
+		return nil
+	}
+	j.done = true
+	j.entry.ChildPid = childPid
+	return &j.entry
+}
+
+// journalUpgrade records the final outcome of the upgrade to the new psflip, with the entry it reported (if any).
+func journalUpgrade(start time.Time, newPid int, entry *journalEntry, err error) {
+	if config.Journal.Path == "" {
+		return
+	}
+	var e journalEntry
+	if entry != nil && entry.NewPid == newPid {
+		e = *entry
+	} else {
+		// The new psflip could not report, e.g. the configuration was refused or it crashed
+		figs.Preview(func() {
+			e = newJournalEntry(start, os.Getpid())
+		})
+		e.NewPid = newPid
+		e.Generation = generation + 1
+	}
+	appendJournal(e, err)
+}
+
+// appendJournal appends the entry with the outcome to the journal, keeping the configured number of entries.
+func appendJournal(e journalEntry, err error) {
+	if e.Phases == nil {
+		e.Phases = make(map[string]float64)
+	}
+	e.Phases["total"] = time.Since(e.Time).Seconds()
+	e.Outcome = "succeeded"
+	if err != nil {
+		e.Outcome = "failed"
+		e.Reason = failureReason(err)
+		e.Error = err.Error()
+	}
+	if err := writeJournal(config.Journal.Path.String(), config.Journal.MaxEntries, e); err != nil {
+		slog.Error("journal.write_failed", "path", config.Journal.Path, "err", err)
+	}
+}
+
+// writeJournal appends the entry to the file, dropping the oldest entries over max. The file is replaced
+// atomically, so that readers never see a partial journal.
+func writeJournal(path string, max int, e journalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var lines [][]byte
+	for _, l := range bytes.Split(b, []byte("\n")) {
+		if len(l) > 0 {
+			lines = append(lines, l)
+		}
+	}
+	lines = append(lines, line)
+	if len(lines) > max {
+		lines = lines[len(lines)-max:]
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, append(bytes.Join(lines, []byte("\n")), '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// hashFile returns the hex SHA-256 of the file, or an empty string if it cannot be read.
+func hashFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
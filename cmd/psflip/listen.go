@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cloudflare/tableflip"
+	"github.com/mwek/psflip/pkg/figs"
+	"github.com/mwek/psflip/pkg/systemd"
+)
+
+// activated holds the sockets passed by systemd socket activation, keyed by the proxy listen address.
+var activated = map[string]*os.File{}
+
+// inheritSystemd matches the sockets passed by systemd to the proxy listeners, by name or by address.
+func inheritSystemd(c *Config) {
+	for _, s := range systemd.Sockets() {
+		addr, err := fileAddr(s.File)
+		if err != nil {
+			slog.Warn("systemd.socket_ignored", "socket", s.Name(), "err", err)
+			s.Close()
+			continue
+		}
+		p := matchSystemd(c, s, addr)
+		if p == nil {
+			slog.Warn("systemd.socket_ignored", "socket", s.Name(), "err", "no matching proxy", "addr", addr.String())
+			s.Close()
+			continue
+		}
+		slog.Info("systemd.socket_inherited", "socket", s.Name(), "listen", p.Listen)
+		activated[p.Listen.String()] = s.File
+	}
+}
+
+// fileAddr returns the local address of the socket.
+func fileAddr(f *os.File) (net.Addr, error) {
+	if l, err := net.FileListener(f); err == nil {
+		defer l.Close()
+		return l.Addr(), nil
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	return pc.LocalAddr(), nil
+}
+
+// matchSystemd returns the proxy listener matching the systemd socket, preferring the name over the address.
+func matchSystemd(c *Config, s systemd.Socket, addr net.Addr) *ProxyConfig {
+	for i := range c.Proxy {
+		p := &c.Proxy[i]
+		if _, ok := activated[p.Listen.String()]; ok {
+			continue
+		}
+		if p.Listen.IsFd() && (p.Listen.Address == s.Name() || p.Listen.Address == strconv.Itoa(s.Fd)) {
+			return p
+		}
+		if !p.Listen.IsFd() && p.Name.String() == s.Name() {
+			return p
+		}
+	}
+	for i := range c.Proxy {
+		p := &c.Proxy[i]
+		if _, ok := activated[p.Listen.String()]; !ok && sameAddr(p.Listen, addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// sameAddr reports whether the configured address describes the listening address.
+func sameAddr(na figs.NetworkAddr, addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ta, err := net.ResolveTCPAddr(na.Network, na.Address)
+		if err != nil || ta.Port != a.Port {
+			return false
+		}
+		return sameIP(ta.IP, a.IP)
+	case *net.UDPAddr:
+		ua, err := net.ResolveUDPAddr(na.Network, na.Address)
+		if err != nil || ua.Port != a.Port {
+			return false
+		}
+		return sameIP(ua.IP, a.IP)
+	case *net.UnixAddr:
+		return na.Network == a.Net && na.Address == a.Name
+	default:
+		return false
+	}
+}
+
+// sameIP reports whether the configured IP describes the listening IP.
+func sameIP(configured, listening net.IP) bool {
+	if len(configured) == 0 || configured.IsUnspecified() {
+		return listening.IsUnspecified()
+	}
+	return configured.Equal(listening)
+}
+
+// socketFile returns the pre-opened socket for the proxy listener, if any.
+func socketFile(p *ProxyConfig) (*os.File, error) {
+	if f, ok := activated[p.Listen.String()]; ok {
+		delete(activated, p.Listen.String())
+		return f, nil
+	}
+	if !p.Listen.IsFd() {
+		return nil, nil
+	}
+	fd, err := strconv.Atoi(p.Listen.Address)
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("no socket named %s", p.Listen.Address)
+	}
+	return os.NewFile(uintptr(fd), p.Listen.String()), nil
+}
+
+// listen returns the listener for the proxy, inheriting it from the previous psflip or systemd.
+func listen(upg *tableflip.Upgrader, p *ProxyConfig) (net.Listener, error) {
+	l, err := upg.ListenWithCallback(p.Listen.Network, p.Listen.Address, func(network, address string) (net.Listener, error) {
+		f, err := socketFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			defer f.Close()
+			return net.FileListener(f)
+		}
+		if isUnixPath(network, address) {
+			removeStale(network, address)
+		}
+		return net.Listen(network, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if isUnixPath(p.Listen.Network, p.Listen.Address) {
+		if err := chownSocket(p); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// listenPacket returns the packet connection for the proxy, inheriting it from the previous psflip or systemd.
+func listenPacket(upg *tableflip.Upgrader, p *ProxyConfig) (net.PacketConn, error) {
+	pc, err := upg.ListenPacketWithCallback(p.Listen.Network, p.Listen.Address, func(network, address string) (net.PacketConn, error) {
+		f, err := socketFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			defer f.Close()
+			return net.FilePacketConn(f)
+		}
+		if isUnixPath(network, address) {
+			removeStale(network, address)
+		}
+		return net.ListenPacket(network, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if isUnixPath(p.Listen.Network, p.Listen.Address) {
+		if err := chownSocket(p); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+	return pc, nil
+}
+
+// isUnixPath reports whether the address is a unix socket bound to the filesystem.
+func isUnixPath(network, address string) bool {
+	switch network {
+	case "unix", "unixpacket", "unixgram":
+		return !strings.HasPrefix(address, "@")
+	default:
+		return false
+	}
+}
+
+// removeStale removes the unix socket left behind by a crashed process, i.e. a socket nobody listens on.
+func removeStale(network, path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	c, err := net.Dial(network, path)
+	if err == nil {
+		c.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		slog.Info("socket.stale_removed", "path", path)
+		os.Remove(path)
+	}
+}
+
+// chownSocket applies the configured mode and ownership to the unix socket file.
+func chownSocket(p *ProxyConfig) error {
+	path := p.Listen.Address
+	if p.Mode != 0 {
+		if err := os.Chmod(path, p.Mode.FileMode()); err != nil {
+			return err
+		}
+	}
+	if p.Owner == "" && p.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if p.Owner != "" {
+		id, err := lookupID(p.Owner.String(), func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid owner %s: %w", p.Owner, err)
+		}
+		uid = id
+	}
+	if p.Group != "" {
+		id, err := lookupID(p.Group.String(), func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid group %s: %w", p.Group, err)
+		}
+		gid = id
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// lookupID resolves the numeric ID, or looks the name up.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// listenFile returns the listening socket for the proxy, to be passed to the child.
+func listenFile(upg *tableflip.Upgrader, p *ProxyConfig) (*os.File, error) {
+	var c io.Closer
+	var err error
+	if p.packet() {
+		c, err = listenPacket(upg, p)
+	} else {
+		c, err = listen(upg, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close() // the upgrader keeps its own copy
+	fc, ok := c.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T cannot be passed to the child", c)
+	}
+	return fc.File()
+}
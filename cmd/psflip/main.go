@@ -4,16 +4,21 @@ import (
 	"context"
 	"encoding/gob"
 	"errors"
-	logger "log"
+	"fmt"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/tableflip"
 	"github.com/kkyr/fig"
 	"github.com/mwek/psflip/pkg/figs"
 	"github.com/mwek/psflip/pkg/healthcheck"
+	"github.com/mwek/psflip/pkg/process"
 	tcpproxy "github.com/mwek/psflip/pkg/proxy"
+	"github.com/mwek/psflip/pkg/systemd"
 
 	flag "github.com/spf13/pflag"
 )
@@ -23,19 +28,25 @@ type Config struct {
 	// Cmd stores the child command to start
 	Cmd []figs.TString `validate:"required"`
 	// WorkDir stores the working directory for the child process. By default, it's the working directory of the psflip process.
-	WorkDir figs.TString
+	WorkDir figs.TString `yaml:"workDir"`
 	// Env stores the extra environment to be passed to the child process.
 	Env []figs.TString
 	// Pidfile (if not empty) describes the path with the PID of the active psflip
 	Pidfile figs.TString
-	// Quiet suppresses any log output from printf
+	// Quiet suppresses any log output
 	Quiet bool
+	// Log controls the log output of psflip and the proxy.
+	Log struct {
+		// Format of the log lines: "text" or "json".
+		Format string `default:"text"`
+		// Level is the lowest level logged: "debug", "info", "warn" or "error".
+		Level string `default:"info"`
+	}
+	// Control is the path of the unix socket accepting control commands. Disabled by default.
+	Control figs.TString
 
 	// Proxy controls the proxying behavior of psflip.
-	Proxy []struct {
-		Listen  figs.NetworkAddr `validate:"required"`
-		Forward figs.NetworkAddr `validate:"required"`
-	}
+	Proxy []ProxyConfig
 
 	// Upgrade controls the psflip upgrade process.
 	Upgrade struct {
@@ -43,6 +54,16 @@ type Config struct {
 		Signal figs.Signal `default:"SIGHUP"`
 		// Timeout after the child is considered "unhealthy"
 		Timeout time.Duration `default:"1m"`
+		// Shadow mirrors live traffic to the new child before it takes over.
+		Shadow struct {
+			// Window of mirroring the traffic after the new child is healthy. Disabled by default.
+			Window time.Duration `default:"0s"`
+			// Sample is the fraction of connections mirrored to the new child.
+			Sample float64 `default:"1"`
+		}
+		// Handover makes the old psflip stop accepting new connections right before the new psflip starts,
+		// so that the old and the new child never both accept them.
+		Handover bool
 	}
 
 	// Shutdown controls the child's graceful shutdown.
@@ -57,6 +78,209 @@ type Config struct {
 
 	// Healthcheck describes when to assume the child is healthy.
 	Healthcheck healthcheck.Config
+
+	// Hooks run commands at the lifecycle points of the child. A failed PreStart or PostReady hook fails the start
+	// of psflip, aborting the upgrade.
+	Hooks struct {
+		// PreStart runs before starting the child.
+		PreStart *HookConfig `yaml:"preStart"`
+		// PostReady runs once the child is healthy, e.g. to warm the caches or register in service discovery.
+		PostReady *HookConfig `yaml:"postReady"`
+		// PreStop runs before the shutdown of the child, e.g. to deregister it or drain it.
+		PreStop *HookConfig `yaml:"preStop"`
+		// PostStop runs after the child exited, with its exit code in PSFLIP_EXIT_CODE.
+		PostStop *HookConfig `yaml:"postStop"`
+	}
+
+	// Watchdog controls the pings of the systemd watchdog, enabled by WatchdogSec= of the unit.
+	Watchdog struct {
+		// Liveness probe required to pass before every ping. By default, the child only needs to be running.
+		Liveness *healthcheck.Config
+	}
+
+	// Journal records every upgrade attempt as a JSON line, for post-mortems.
+	Journal struct {
+		// Path of the journal file, appended by every psflip. Disabled by default.
+		Path figs.TString
+		// MaxEntries kept in the journal, dropping the oldest ones.
+		MaxEntries int `default:"100" yaml:"maxEntries"`
+	}
+
+	// Metrics controls reporting the statistics of psflip.
+	Metrics struct {
+		// Interval of logging the statistics of every proxy listener. Disabled by default.
+		Interval time.Duration
+		// Listen is the address serving the Prometheus metrics of the supervisor at /metrics. Disabled by default.
+		Listen figs.NetworkAddr
+	}
+}
+
+// ProxyConfig describes a single listener of psflip.
+type ProxyConfig struct {
+	// Listen is the address accepting the connections.
+	Listen figs.NetworkAddr `validate:"required"`
+	// Forward is the address the connections are proxied to. Required unless the listener is activated.
+	Forward figs.NetworkAddr
+	// Hosts route the connections to other forward addresses by the TLS SNI or the HTTP Host header.
+	Hosts []HostConfig
+	// Activate passes the listener to the child via systemd socket activation instead of proxying the connections.
+	Activate bool
+	// Name of the activated listener passed in LISTEN_FDNAMES.
+	Name figs.TString `default:"psflip"`
+	// Mode of the unix socket file. By default, it follows the umask of psflip.
+	Mode figs.FileMode
+	// Owner of the unix socket file, by name or ID.
+	Owner figs.TString
+	// Group of the unix socket file, by name or ID.
+	Group figs.TString
+
+	// MaxConnections limits the concurrently proxied connections. Unlimited by default.
+	MaxConnections int `yaml:"maxConnections"`
+	// Overflow policy over MaxConnections: "queue" keeps new connections in the listen backlog, "reject" closes them.
+	Overflow string `default:"queue"`
+	// DialTimeout limits connecting to the forward address.
+	DialTimeout time.Duration `default:"10s" yaml:"dialTimeout"`
+	// ResolveTTL caches the resolved forward addresses. By default, the forward host is resolved on every connection.
+	ResolveTTL time.Duration `yaml:"resolveTTL"`
+	// IdleTimeout closes the connections without traffic in either direction. Disabled by default.
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// Keepalive sets the TCP keepalive period. Negative disables the keepalives.
+	Keepalive time.Duration `default:"15s" yaml:"keepAlive"`
+	// NoDelay sets TCP_NODELAY, disabling Nagle's algorithm. Enabled by default.
+	NoDelay *bool `yaml:"noDelay"`
+	// DrainTimeout cuts the connections still open after psflip stops accepting them. Disabled by default.
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+	// AccessLog logs every proxied connection when it closes.
+	AccessLog bool `yaml:"accessLog"`
+	// Allow accepts only the clients within the given networks. All clients are allowed by default.
+	Allow []figs.CIDR
+	// Deny rejects the clients within the given networks, taking precedence over Allow.
+	Deny []figs.CIDR
+	// RateLimit limits the new connections from a single client address. Unlimited by default.
+	RateLimit struct {
+		// Rate of new connections per second.
+		Rate float64
+		// Burst of new connections allowed over the rate.
+		Burst int `default:"1"`
+	} `yaml:"rateLimit"`
+}
+
+// HostConfig routes the connections for a host name.
+type HostConfig struct {
+	// Host name, or "*.domain" matching the subdomains.
+	Host figs.TString `validate:"required"`
+	// Forward is the address the connections for the host are proxied to.
+	Forward figs.NetworkAddr `validate:"required"`
+}
+
+// HookConfig describes a command run at a lifecycle point of the child.
+type HookConfig struct {
+	// Cmd is the command with its arguments, run in the working directory and the environment of the child.
+	Cmd []figs.TString `validate:"required"`
+	// Timeout kills the command if it does not finish in time, failing the hook.
+	Timeout time.Duration `default:"30s"`
+}
+
+// packet reports whether the proxy relays packets rather than streams.
+func (p *ProxyConfig) packet() bool {
+	return p.Listen.IsPacket() || p.Forward.IsPacket()
+}
+
+// options returns the proxy options of the listener.
+func (p *ProxyConfig) options() []tcpproxy.Option {
+	opts := []tcpproxy.Option{
+		tcpproxy.DialTimeout(p.DialTimeout),
+		tcpproxy.IdleTimeout(p.IdleTimeout),
+		tcpproxy.KeepAlive(p.Keepalive),
+		tcpproxy.DrainTimeout(p.DrainTimeout),
+	}
+	for _, h := range p.Hosts {
+		opts = append(opts, tcpproxy.Host(h.Host.String(), h.Forward.Network, h.Forward.Address))
+	}
+	if p.ResolveTTL > 0 {
+		opts = append(opts, tcpproxy.ResolveTTL(p.ResolveTTL))
+	}
+	if p.MaxConnections > 0 {
+		opts = append(opts, tcpproxy.MaxConnections(p.MaxConnections, p.Overflow == "reject"))
+	}
+	if p.NoDelay != nil {
+		opts = append(opts, tcpproxy.NoDelay(*p.NoDelay))
+	}
+	if p.AccessLog {
+		opts = append(opts, tcpproxy.AccessLog())
+	}
+	for _, c := range p.Allow {
+		opts = append(opts, tcpproxy.Allow(c.Prefix()))
+	}
+	for _, c := range p.Deny {
+		opts = append(opts, tcpproxy.Deny(c.Prefix()))
+	}
+	if p.RateLimit.Rate > 0 {
+		opts = append(opts, tcpproxy.RateLimit(p.RateLimit.Rate, p.RateLimit.Burst))
+	}
+	return opts
+}
+
+// upgradeBudget is the longest the new psflip may take to become ready.
+func (c *Config) upgradeBudget() time.Duration {
+	d := c.Upgrade.Timeout + c.Upgrade.Shadow.Window + c.startHooksTimeout()
+	if c.Upgrade.Handover {
+		d += handoverTimeout
+	}
+	return d
+}
+
+// validate checks the constraints not expressible by fig tags.
+func (c *Config) validate(path string) error {
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("invalid log format: %s", c.Log.Format)
+	}
+	if err := new(slog.Level).UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return fmt.Errorf("invalid log level: %s", c.Log.Level)
+	}
+	if c.Journal.Path != "" && c.Journal.MaxEntries <= 0 {
+		return fmt.Errorf("invalid journal maxEntries: %d", c.Journal.MaxEntries)
+	}
+	if c.Watchdog.Liveness != nil {
+		// The ping follows the probe on every tick at half of the watchdog timeout: a quick probe followed by a slow
+		// one delays the ping by the probe, which must leave a margin
+		hc, err := healthcheck.New(*c.Watchdog.Liveness)
+		if err != nil {
+			return fmt.Errorf("invalid watchdog liveness probe: %w", err)
+		}
+		if timeout, _ := systemd.WatchdogInterval(); timeout > 0 && hc.ProbeTimeout() >= timeout/4 {
+			return fmt.Errorf("watchdog liveness probe may take %s, not under a quarter of the watchdog timeout %s", hc.ProbeTimeout(), timeout)
+		}
+	}
+	if c.Upgrade.Shadow.Window > 0 {
+		if err := c.validateShadow(path); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.Proxy {
+		switch {
+		case p.Overflow != "queue" && p.Overflow != "reject":
+			return fmt.Errorf("proxy %s: invalid overflow: %s", p.Listen, p.Overflow)
+		case p.Listen.Network == "srv":
+			return fmt.Errorf("proxy %s: cannot listen on a SRV record", p.Listen)
+		case p.Activate:
+			if len(p.Hosts) > 0 {
+				return fmt.Errorf("proxy %s: cannot route hosts of an activated listener", p.Listen)
+			}
+		case p.Forward.Network == "":
+			return fmt.Errorf("proxy %s: forward is required", p.Listen)
+		case p.Forward.IsFd():
+			return fmt.Errorf("proxy %s: cannot forward to %s", p.Listen, p.Forward)
+		case !p.Listen.IsFd() && p.Listen.IsPacket() != p.Forward.IsPacket():
+			return fmt.Errorf("proxy %s: cannot forward to %s", p.Listen, p.Forward)
+		}
+		for _, h := range p.Hosts {
+			if p.packet() || h.Forward.IsFd() || h.Forward.IsPacket() {
+				return fmt.Errorf("proxy %s: cannot forward %s to %s", p.Listen, h.Host, h.Forward)
+			}
+		}
+	}
+	return nil
 }
 
 // Locals store the local variable for further reuse in configuration.
@@ -69,26 +293,80 @@ var (
 	config  Config
 )
 
-func log(format string, v ...any) {
-	if config.Quiet {
-		return
+// setupLogging makes the configured logger the default one, shared with the proxy.
+func setupLogging(c *Config) {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Log.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch {
+	case c.Quiet:
+		h = slog.DiscardHandler
+	case c.Log.Format == "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		h = slog.NewTextHandler(os.Stderr, opts)
 	}
-	logger.Printf(format, v...)
+	slog.SetDefault(slog.New(h))
 }
 
-func upgrade(ctx context.Context, upg *tableflip.Upgrader) {
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, config.Upgrade.Signal.Syscall())
+// fatal logs the event with the error and exits.
+func fatal(event string, err error) {
+	slog.Error(event, "err", err)
+	os.Exit(1)
+}
+
+func upgrade(ctx context.Context, sig <-chan os.Signal, upg *tableflip.Upgrader, proxy *tcpproxy.TCPProxy, mirrors shadows, ctl *control) {
 	for {
+		var result chan<- error
 		select {
 		case <-sig:
-			if err := upg.Upgrade(); err != nil {
-				log("error upgrading: %v", err)
-				// TODO(mwek): systemd-notify READY=1 -- systemd doesn't seem to have
-			}
+		case result = <-ctl.upgrades:
 		case <-ctx.Done():
 			return
 		}
+
+		start := ctl.upgrading()
+		os.Setenv(upgradeStartEnv, start.Format(time.RFC3339Nano))
+		slog.Info("upgrade.started")
+		notify(systemd.Reloading, systemd.Monotonic())
+		// Do not fork for a configuration the new psflip would refuse
+		var err error
+		figs.Preview(func() {
+			_, err = checkConfig(*fConfig)
+		})
+		if err != nil {
+			err = ctl.upgraded(failed(failInvalidConfig, fmt.Errorf("refusing to upgrade: %w", err)))
+			slog.Error("upgrade.failed", "reason", failureReason(err), "err", err)
+			notify(systemd.Ready)
+		} else {
+			err = upg.Upgrade()
+			if err != nil || config.Journal.Path != "" {
+				ctl.awaitReport(reportTimeout)
+			}
+			// Either the new child takes over the traffic, or it is gone: stop mirroring to it
+			mirrors.stop()
+			if err = ctl.upgraded(err); err != nil {
+				proxy.Resume()
+				slog.Error("upgrade.failed", "reason", failureReason(err), "err", err)
+				// We keep running: finish the reload
+				notify(systemd.Ready)
+			} else {
+				slog.Info("upgrade.succeeded")
+				// The new psflip waits for the metrics before serving them
+				ctl.handoff()
+			}
+		}
+		if result != nil {
+			result <- err
+		}
+	}
+}
+
+// notify sends the states to systemd, if psflip runs as a notify service.
+func notify(states ...string) {
+	if err := systemd.Notify(states...); err != nil {
+		slog.Warn("systemd.notify_failed", "err", err)
 	}
 }
 
@@ -119,44 +397,123 @@ func pidForwarder(upg *tableflip.Upgrader) (r *os.File, w *os.File, err error) {
 	return
 }
 
-func main() {
-	flag.Parse()
+// loadConfig loads the locals and then the configuration from the file.
+func loadConfig(path string) (Config, error) {
+	c, err := parseConfig(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := c.validate(path); err != nil {
+		return Config{}, fmt.Errorf("invalid psflip configuration: %w", err)
+	}
+	return c, nil
+}
 
+// parseConfig loads the configuration without validating it.
+func parseConfig(path string) (Config, error) {
 	// Load locals
 	var locals Locals
-	err := fig.Load(&locals, fig.File(*fConfig))
+	err := fig.Load(&locals, fig.File(path))
 	if err != nil {
-		logger.Fatalf("invalid psflip locals: %v", err)
+		return Config{}, fmt.Errorf("invalid psflip locals: %w", err)
 	}
 	figs.SetLocals(locals.Locals)
 
 	// Load configuration
-	err = fig.Load(&config, fig.File(*fConfig))
+	var c Config
+	if err := fig.Load(&c, fig.File(path)); err != nil {
+		return Config{}, fmt.Errorf("invalid psflip configuration: %w", err)
+	}
+	return c, nil
+}
+
+func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "upgrade":
+			os.Exit(upgradeCommand(os.Args[2:]))
+		case "check":
+			os.Exit(checkCommand(os.Args[2:]))
+		}
+	}
+	flag.Parse()
+
+	var err error
+	config, err = loadConfig(*fConfig)
 	if err != nil {
-		logger.Fatalf("invalid psflip configuration: %v", err)
+		fatal("config.invalid", err)
 	}
+	setupLogging(&config)
 
 	// Support zero-downtime upgrades
 	buffer := 5 * time.Second // extra buffer to prevent kills from tableflip
 	upg, err := tableflip.New(tableflip.Options{
 		PIDFile:        config.Pidfile.String(),
-		UpgradeTimeout: config.Upgrade.Timeout + config.Shutdown.Delay + config.Shutdown.Timeout + buffer,
+		UpgradeTimeout: config.upgradeBudget() + config.Shutdown.Delay + config.Shutdown.Timeout + buffer,
 	})
 	if err != nil {
-		logger.Fatalf("invalid tableflip configuration: %v", err)
+		fatal("upgrader.invalid", err)
 	}
 	defer upg.Stop()
+	j := startJournal(upg)
+
+	// Inherit listeners from systemd on the first start; upgrades inherit them from the previous psflip.
+	if !upg.HasParent() {
+		inheritSystemd(&config)
+	}
 
 	sv, err := newSupervisor(&config)
 	if err != nil {
-		logger.Fatalf("faild to create supverisor: %v", err)
+		fatal("supervisor.invalid", err)
+	}
+
+	// Pass activated listeners to the child
+	var sockets []process.Option
+	for _, p := range config.Proxy {
+		if !p.Activate {
+			continue
+		}
+		f, err := listenFile(upg, &p)
+		if err != nil {
+			fatal("proxy.listen_failed", fmt.Errorf("failed to listen on %s: %w", p.Listen, err))
+		}
+		defer f.Close()
+		sockets = append(sockets, process.Socket(p.Name.String(), f))
+	}
+
+	// Setup link with the parent and upgraded children
+	parent, children, err := parentLink(upg)
+	if err != nil {
+		slog.Error("parent.link_failed", "err", err)
+	} else if parent != nil {
+		// children stays open to hand off the metrics on exit
+		defer parent.Close()
+	}
+	if parent != nil {
+		if err := send(parent, message{Hello: true}); err != nil {
+			slog.Error("parent.announce_failed", "err", err)
+		}
+	}
+
+	// Listen on the control socket before starting the child: it changes the umask of the process, which must not
+	// leak into the hooks or the child
+	var controlListener net.Listener
+	if config.Control != "" {
+		controlListener, err = listenControl(upg, config.Control.String())
+		if err != nil {
+			slog.Error("control.listen_failed", "path", config.Control, "err", err)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	err = sv.Start(ctx)
+	err = sv.Start(ctx, sockets...)
 	if err != nil {
-		logger.Fatalf("failed to start child process: %v", err)
+		report(parent, err, j.finish(0))
+		fatal("worker.start_failed", err)
 	}
+	mGeneration.Set(float64(generation))
+	ctl := newControl(sv)
 
 	// On return, terminate the proxy, supervisor and proxy exit code
 	proxy := tcpproxy.New()
@@ -166,12 +523,31 @@ func main() {
 			cancel()
 			<-sv.Exit()
 			proxy.Wait()
+			// Hand the increase of the metrics, including the shutdown of the child, off to the new psflip
+			ctl.handoff()
+			if drained, cut := proxy.Drained(); drained+cut > 0 {
+				slog.Info("proxy.drained", "drained", drained, "cut", cut)
+			}
+			if config.Metrics.Interval > 0 {
+				for _, s := range proxy.Stats() {
+					slog.Info("proxy.stats", "stats", s)
+				}
+			}
 			os.Exit(sv.ExitCode())
 		}
 	}()
 
-	// Handle upgrade signals
-	go upgrade(ctx, upg)
+	// Traffic mirrors for the upgraded children
+	mirrors := make(shadows, len(config.Proxy))
+	for _, p := range config.Proxy {
+		if !p.Activate && !p.packet() {
+			mirrors[p.Listen.String()] = &tcpproxy.Shadow{}
+		}
+	}
+
+	// Upgrade signals received before ready are handled once ready
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, config.Upgrade.Signal.Syscall())
 
 	// Setup PID-forwarder pipe
 	pidpipeR, pidpipeW, err := pidForwarder(upg)
@@ -181,52 +557,240 @@ func main() {
 	defer pidpipeR.Close()
 	defer pidpipeW.Close()
 
+	go receive(children, func(m message) {
+		if m.Hello {
+			ctl.started(m.Pid)
+		}
+		if m.Error != "" || m.Journal != nil {
+			ctl.outcome(m)
+		}
+		if m.Metrics != nil {
+			registry.Merge(m.Metrics)
+		}
+		if m.Shadow != nil {
+			mirrors.start(m.Pid, m.Shadow)
+		}
+		if m.Handover {
+			proxy.Pause()
+			at := time.Now()
+			slog.Info("handover.paused", "pid", m.Pid)
+			if err := send(children, message{Handover: true, To: m.Pid, At: at}); err != nil {
+				slog.Error("handover.ack_failed", "err", err)
+			}
+		}
+	})
+	handover := make(chan message, 1)
+	aborted := make(chan struct{})
+	var abortOnce sync.Once
+	handedOff := make(chan struct{})
+	var handoffOnce sync.Once
+	go receive(parent, func(m message) {
+		if m.Handover && m.To == os.Getpid() {
+			select {
+			case handover <- m:
+			default:
+			}
+		}
+		if m.Metrics != nil {
+			registry.Merge(m.Metrics)
+			handoffOnce.Do(func() { close(handedOff) })
+		}
+		if m.Abort && m.To == os.Getpid() {
+			abortOnce.Do(func() {
+				slog.Warn("upgrade.aborted", "by", m.Pid)
+				close(aborted)
+			})
+		}
+	})
+
+	// Serve the control socket; upgraded psflip takes it over once ready
+	if controlListener != nil {
+		defer controlListener.Close()
+	}
+	ctl.children = children
+	if controlListener != nil && !upg.HasParent() {
+		go ctl.serve(controlListener)
+	}
+
+	// Serve the metrics; upgraded psflip takes them over once ready
+	var metricsListener net.Listener
+	metricsServer := newMetricsServer()
+	if config.Metrics.Listen.Address != "" {
+		metricsListener, err = listenMetrics(upg, config.Metrics.Listen.Network, config.Metrics.Listen.Address)
+		if err != nil {
+			slog.Error("metrics.listen_failed", "listen", config.Metrics.Listen, "err", err)
+		} else {
+			defer metricsListener.Close()
+		}
+	}
+	if metricsListener != nil && !upg.HasParent() {
+		go serveMetrics(metricsServer, metricsListener)
+	}
+
+	// fail reports why the upgrade to this psflip failed to the parent, with the journal entry
+	fail := func(err error) {
+		report(parent, err, j.finish(sv.ChildPid()))
+	}
+	abort := func() {
+		fail(failed(failAborted, errors.New("upgrade aborted")))
+	}
+
 	select {
 	case <-sv.Exit(): // supervisor never got ready
+		fail(sv.Err())
+		return
+	case <-aborted:
+		abort()
+		return
+	case <-ctl.Stop():
 		return
 	case <-sv.Ready(): // we are healthy
 	}
+	j.phase("healthy")
+
+	// Mirror traffic to our child before taking over
+	if window := config.Upgrade.Shadow.Window; parent != nil && window > 0 && len(mirrors) > 0 {
+		if err := send(parent, message{Shadow: shadowTargets(&config)}); err != nil {
+			slog.Error("shadow.request_failed", "err", err)
+		} else {
+			slog.Info("shadow.started", "window", window)
+			select {
+			case <-sv.Exit(): // child died when shadowing
+				fail(failed(failChildExited, errors.New("child exited when shadowing")))
+				return
+			case <-aborted:
+				abort()
+				return
+			case <-time.After(window):
+			}
+			j.phase("shadow")
+		}
+	}
+
+	// Accept connections only after the parent stops accepting them
+	if config.Upgrade.Handover && parent != nil {
+		proxy.Pause()
+	}
 
 	// Setup proxying
 	for _, p := range config.Proxy {
-		listener, err := upg.Listen(p.Listen.Network, p.Listen.Address)
-		if err != nil {
-			log("failed to listen on %s: %v", p.Listen, err)
-			return
+		var serve func() error
+		switch {
+		case p.Activate:
+			continue
+		case p.packet():
+			pc, err := listenPacket(upg, &p)
+			if err != nil {
+				slog.Error("proxy.listen_failed", "listen", p.Listen, "err", err)
+				fail(failed(failListen, fmt.Errorf("failed to listen on %s: %w", p.Listen, err)))
+				return
+			}
+			serve = proxy.AddPacket(pc, p.Forward.Network, p.Forward.Address, p.options()...)
+		default:
+			listener, err := listen(upg, &p)
+			if err != nil {
+				slog.Error("proxy.listen_failed", "listen", p.Listen, "err", err)
+				fail(failed(failListen, fmt.Errorf("failed to listen on %s: %w", p.Listen, err)))
+				return
+			}
+			opts := append(p.options(), tcpproxy.Mirror(mirrors[p.Listen.String()]))
+			serve = proxy.Add(listener, p.Forward.Network, p.Forward.Address, opts...)
 		}
-		serve := proxy.Add(listener, p.Forward.Network, p.Forward.Address)
 		go func() {
 			if err := serve(); err != nil {
 				if errors.Is(err, tcpproxy.ErrServerClosed) {
 					return
 				}
-				log("failed to serve: %v", err)
+				slog.Error("proxy.serve_failed", "err", err)
 			}
 		}()
 	}
 
+	// Take over accepting new connections from the parent
+	if config.Upgrade.Handover && parent != nil {
+		requested := time.Now()
+		if err := send(parent, message{Handover: true}); err != nil {
+			slog.Error("handover.request_failed", "err", err)
+			return
+		}
+		select {
+		case m := <-handover:
+			slog.Info("handover.completed", "pid", m.Pid, "at", m.At, "switchover", m.At.Sub(requested))
+		case <-time.After(handoverTimeout):
+			slog.Error("handover.timeout", "timeout", handoverTimeout)
+			fail(failed(failHandover, fmt.Errorf("no handover acknowledgement in %s", handoverTimeout)))
+			return
+		case <-sv.Exit():
+			fail(failed(failChildExited, errors.New("child exited during handover")))
+			return
+		case <-aborted:
+			abort()
+			return
+		}
+		proxy.Resume()
+		j.phase("handover")
+	}
+
+	if config.Metrics.Interval > 0 {
+		go logStats(ctx, proxy, config.Metrics.Interval)
+	}
+
 	// Signal we are ready
 	err = gob.NewEncoder(pidpipeW).Encode(os.Getpid())
 	if pidpipeW != nil && err != nil {
-		log("failed to write child pid: %v", err)
+		slog.Error("upgrade.pid_write_failed", "err", err)
+	}
+
+	// The parent records the journal entry once the upgrade succeeds
+	j.phase("ready")
+	if e := j.finish(sv.ChildPid()); e != nil {
+		if err := send(parent, message{Journal: e}); err != nil {
+			slog.Error("journal.report_failed", "err", err)
+		}
 	}
 
 	err = upg.Ready()
 	if err != nil {
-		log("failed to signal ready: %v", err)
+		slog.Error("upgrade.ready_failed", "err", err)
 		return
 	}
+	// Upgraded psflip becomes ready through the parent, as systemd accepts notifications only from the main PID
+	if !upg.HasParent() {
+		notify(systemd.Ready)
+	}
+	go watchdog(ctx, upg, sv)
+	ctl.setState(stateRunning)
+	// Handle upgrade signals and commands
+	go upgrade(ctx, sig, upg, proxy, mirrors, ctl)
+	if controlListener != nil && upg.HasParent() {
+		go ctl.serve(controlListener)
+	}
+	if metricsListener != nil && upg.HasParent() {
+		// Serve the metrics only once handed off by the parent, so that the counters never go back
+		select {
+		case <-handedOff:
+		case <-time.After(handoffTimeout):
+			slog.Warn("metrics.handoff_timeout", "timeout", handoffTimeout)
+		}
+		go serveMetrics(metricsServer, metricsListener)
+	}
 
 	// exit on upgrade or on child exit
 	select {
 	// Upgrade cleanup: notify about PID change
 	case <-upg.Exit():
+		<-ctl.Upgraded()
 		var childPid int
 		if gob.NewDecoder(pidpipeR).Decode(&childPid) == nil {
-			// # TODO(mwek): systemd-notify --pid &childPid
+			notify(systemd.MainPid(childPid), systemd.Ready)
 		}
+		metricsServer.Close()
 	// Child exit: cleanup and proxy error code
 	case <-sv.Exit():
 		os.Remove(config.Pidfile.String())
+	// Stop command: shutdown the child
+	case <-ctl.Stop():
+		slog.Info("shutdown.requested")
+		os.Remove(config.Pidfile.String())
 	}
 }
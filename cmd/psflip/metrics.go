@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/tableflip"
+	"github.com/mwek/psflip/pkg/metrics"
+	tcpproxy "github.com/mwek/psflip/pkg/proxy"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the supervisor duration histograms.
+var durationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// registry holds the metrics of the supervisor. The counters are handed off to the new psflip on upgrade.
+var registry = &metrics.Registry{}
+
+var (
+	mUpgradeAttempts = registry.Counter("psflip_upgrade_attempts_total", "Upgrades attempted.")
+	mUpgrades        = registry.Counter("psflip_upgrades_total", "Finished upgrades by result.", "result")
+	mUpgradeFailures = registry.Counter("psflip_upgrade_failures_total", "Failed upgrades by reason.", "reason")
+	mHealthchecks    = registry.Histogram("psflip_healthcheck_duration_seconds", "Duration of the healthchecks by check and result.", durationBuckets, "check", "result")
+	mTimeToHealthy   = registry.Histogram("psflip_time_to_healthy_seconds", "Time from starting the child until it is healthy.", durationBuckets)
+	mChildStarts     = registry.Counter("psflip_child_starts_total", "Started children, including the ones of the failed upgrades.")
+	mChildExits      = registry.Counter("psflip_child_exits_total", "Exited children by exit code.", "code")
+	mShutdowns       = registry.Histogram("psflip_shutdown_duration_seconds", "Time from signalling the child until it exits, by result.", durationBuckets, "result")
+	mGeneration      = registry.Gauge("psflip_generation", "Generation of the running psflip, counting the upgrades.")
+)
+
+// observeHealthcheck records the duration of the healthcheck.
+func observeHealthcheck(check string, start time.Time, err error) {
+	result := "passed"
+	if err != nil {
+		result = "failed"
+	}
+	mHealthchecks.Observe(time.Since(start).Seconds(), check, result)
+}
+
+// listenMetrics returns the listener serving the metrics, inherited from the previous psflip.
+func listenMetrics(upg *tableflip.Upgrader, network, address string) (net.Listener, error) {
+	return upg.ListenWithCallback(network, address, func(network, address string) (net.Listener, error) {
+		if isUnixPath(network, address) {
+			removeStale(network, address)
+		}
+		return net.Listen(network, address)
+	})
+}
+
+// serveMetrics serves the metrics at /metrics until the server is closed.
+func serveMetrics(srv *http.Server, l net.Listener) {
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		slog.Error("metrics.serve_failed", "err", err)
+	}
+}
+
+// newMetricsServer returns the HTTP server of the metrics.
+func newMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	return &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
+
+// logStats logs the statistics of every proxy listener at the interval, until cancelled.
+func logStats(ctx context.Context, proxy *tcpproxy.TCPProxy, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, s := range proxy.Stats() {
+				slog.Info("proxy.stats", "stats", s)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
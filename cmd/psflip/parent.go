@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cloudflare/tableflip"
+	"github.com/mwek/psflip/pkg/metrics"
+	"golang.org/x/sys/unix"
+)
+
+// message is exchanged between the running psflip and the psflip it upgrades to.
+type message struct {
+	// Pid of the sender
+	Pid int `json:"pid"`
+	// Hello announces the new psflip to the running one
+	Hello bool `json:"hello,omitempty"`
+	// Abort asks the new psflip to exit, cancelling the upgrade
+	Abort bool `json:"abort,omitempty"`
+	// Error tells the running psflip why the new psflip gives up the upgrade, Reason categorizes it
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Metrics hands the counters off to the psflip which keeps running
+	Metrics metrics.Snapshot `json:"metrics,omitempty"`
+	// Journal is the entry of the upgrade to the new psflip, recorded by the running psflip
+	Journal *journalEntry `json:"journal,omitempty"`
+	// Shadow asks the running psflip to mirror traffic to the new child
+	Shadow []shadowTarget `json:"shadow,omitempty"`
+	// Handover asks the running psflip to stop accepting new connections; the reply acknowledges it
+	Handover bool `json:"handover,omitempty"`
+	// To is the PID of the recipient of a reply
+	To int `json:"to,omitempty"`
+	// At is when the running psflip stopped accepting new connections
+	At time.Time `json:"at,omitzero"`
+}
+
+// maxMessage is the largest message accepted over the parent link.
+const maxMessage = 64 * 1024
+
+// handoverTimeout limits waiting for the parent to stop accepting new connections.
+const handoverTimeout = 10 * time.Second
+
+// reportTimeout limits waiting for the new psflip to report the outcome of the upgrade.
+const reportTimeout = time.Second
+
+// handoffTimeout limits waiting for the parent to hand the metrics off after the upgrade.
+const handoffTimeout = 5 * time.Second
+
+// parentLink connects psflip with its parent and its upgraded children over SOCK_SEQPACKET socketpairs passed
+// through the upgrader, so that every message is delivered as a single packet.
+func parentLink(upg *tableflip.Upgrader) (parent *net.UnixConn, children *net.UnixConn, err error) {
+	// Clean returned sockets on error
+	defer func() {
+		if err != nil {
+			if parent != nil {
+				parent.Close()
+				parent = nil
+			}
+			if children != nil {
+				children.Close()
+				children = nil
+			}
+		}
+	}()
+
+	// New socketpair -- one end for myself, the other for the child
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return
+	}
+	// SOCK_CLOEXEC is not portable; the upgrader passes its own copy to the new psflip
+	unix.CloseOnExec(fds[0])
+	unix.CloseOnExec(fds[1])
+	children, err = fileConn(os.NewFile(uintptr(fds[0]), "psflip-children"))
+	if err != nil {
+		unix.Close(fds[1])
+		return
+	}
+	childEnd := os.NewFile(uintptr(fds[1]), "psflip-parent")
+	defer childEnd.Close() // dup'ed by upgrader
+
+	// Get inherited end from upgrader
+	f, err := upg.File("psflip-parent")
+	if err != nil {
+		return
+	}
+	if f != nil {
+		parent, err = fileConn(f)
+		if err != nil {
+			return
+		}
+	}
+	// Set upgrade end to propagate to the next child
+	err = upg.AddFile("psflip-parent", childEnd)
+	return
+}
+
+// fileConn converts the socket file into a connection, closing the file.
+func fileConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, errors.New("parent link is not a unix socket")
+	}
+	return uc, nil
+}
+
+// send delivers the message over the link, stamping it with our PID.
+func send(conn *net.UnixConn, m message) error {
+	if conn == nil {
+		return errors.New("no parent link")
+	}
+	m.Pid = os.Getpid()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// report tells the parent why the upgrade failed, handing off the journal entry and the metrics of the failed child.
+func report(conn *net.UnixConn, err error, entry *journalEntry) {
+	if conn == nil {
+		return
+	}
+	m := message{Error: err.Error(), Reason: failureReason(err), Journal: entry, Metrics: registry.Snapshot()}
+	if err := send(conn, m); err != nil {
+		slog.Error("parent.report_failed", "err", err)
+	}
+}
+
+// Reasons of a failed upgrade, reported in the metrics.
+const (
+	failInvalidConfig = "invalid_config"
+	failChildExited   = "child_exited"
+	failHealthcheck   = "healthcheck_failed"
+	failTimeout       = "timeout"
+	failListen        = "listen_failed"
+	failHandover      = "handover_failed"
+	failHook          = "hook_failed"
+	failAborted       = "aborted"
+	failUnknown       = "unknown"
+)
+
+// failure is an upgrade error categorized by its reason.
+type failure struct {
+	reason string
+	err    error
+}
+
+func failed(reason string, err error) error {
+	return &failure{reason, err}
+}
+
+func (f *failure) Error() string { return f.err.Error() }
+func (f *failure) Unwrap() error { return f.err }
+
+// failureReason returns the reason of the upgrade error.
+func failureReason(err error) string {
+	if f := (*failure)(nil); errors.As(err, &f) {
+		return f.reason
+	}
+	return failUnknown
+}
+
+// receive calls handle for every message arriving over the link until it is closed.
+func receive(conn *net.UnixConn, handle func(message)) {
+	if conn == nil {
+		return
+	}
+	buf := make([]byte, maxMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		var m message
+		if err := json.Unmarshal(buf[:n], &m); err != nil {
+			slog.Warn("parent.invalid_message", "err", err)
+			continue
+		}
+		handle(m)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/mwek/psflip/pkg/figs"
+	tcpproxy "github.com/mwek/psflip/pkg/proxy"
+)
+
+// shadowTarget describes where the running psflip mirrors the traffic of a proxy listener.
+type shadowTarget struct {
+	Listen  string  `json:"listen"`
+	Network string  `json:"network"`
+	Address string  `json:"address"`
+	Sample  float64 `json:"sample"`
+}
+
+// shadows holds the traffic mirrors of proxy listeners, keyed by the listen address.
+type shadows map[string]*tcpproxy.Shadow
+
+// start mirrors the traffic of matching listeners to the new child.
+func (s shadows) start(pid int, targets []shadowTarget) {
+	for _, t := range targets {
+		sh, ok := s[t.Listen]
+		if !ok {
+			slog.Warn("shadow.not_proxied", "pid", pid, "listen", t.Listen)
+			continue
+		}
+		slog.Info("shadow.mirroring", "pid", pid, "listen", t.Listen, "target", t.Network+"://"+t.Address, "sample", t.Sample)
+		sh.Start(t.Network, t.Address, t.Sample)
+	}
+}
+
+// stop stops mirroring the traffic of all listeners.
+func (s shadows) stop() {
+	for _, sh := range s {
+		sh.Stop()
+	}
+}
+
+// validateShadow rejects mirroring the traffic to the live forward address, i.e. to a forward address shared with
+// the configuration of the other AB flag: the client writes would reach the production child twice.
+func (c *Config) validateShadow(path string) error {
+	var live Config
+	var err error
+	figs.Preview(func() {
+		live, err = parseConfig(path)
+	})
+	if err != nil {
+		// reported when loading the configuration of the other AB flag
+		return nil
+	}
+	forwards := make(map[string]figs.NetworkAddr, len(live.Proxy))
+	for _, p := range live.Proxy {
+		forwards[p.Listen.String()] = p.Forward
+	}
+	for _, t := range shadowTargets(c) {
+		if f, ok := forwards[t.Listen]; ok && f.Network == t.Network && f.Address == t.Address {
+			return fmt.Errorf("proxy %s: cannot shadow to the live forward address %s; it must differ between the AB flags", t.Listen, f)
+		}
+	}
+	return nil
+}
+
+// shadowTargets returns the targets the running psflip should mirror the traffic to.
+func shadowTargets(c *Config) []shadowTarget {
+	sample := min(max(c.Upgrade.Shadow.Sample, 0), 1)
+	targets := make([]shadowTarget, 0, len(c.Proxy))
+	for _, p := range c.Proxy {
+		// Routed hosts would all be mirrored to the default forward address.
+		if p.Activate || p.packet() || len(p.Hosts) > 0 {
+			continue
+		}
+		targets = append(targets, shadowTarget{
+			Listen:  p.Listen.String(),
+			Network: p.Forward.Network,
+			Address: p.Forward.Address,
+			Sample:  sample,
+		})
+	}
+	return targets
+}
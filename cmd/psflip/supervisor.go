@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/mwek/psflip/pkg/figs"
@@ -19,6 +23,8 @@ type supervisor struct {
 	ready chan struct{}
 	exit  chan struct{}
 	ec    int
+	err   error
+	pid   atomic.Int64
 }
 
 func newSupervisor(c *Config) (*supervisor, error) {
@@ -48,25 +54,40 @@ func (sv *supervisor) ExitCode() int {
 	return sv.ec
 }
 
+// Err returns why the child never got healthy, once exited.
+func (sv *supervisor) Err() error {
+	return sv.err
+}
+
+// ChildPid returns the PID of the started child, or zero.
+func (sv *supervisor) ChildPid() int {
+	return int(sv.pid.Load())
+}
+
 func (sv *supervisor) cleanup(child *process.Process) {
 	if child == nil || child.Exited != nil {
 		return
 	}
 
+	sv.hook("preStop", sv.Hooks.PreStop, childEnv(child))
+
 	if sv.Shutdown.Delay > 0 {
-		log("worker %s: waiting %s before shutdown", child, sv.Shutdown.Delay)
+		slog.Info("shutdown.delay", "worker", child.String(), "delay", sv.Shutdown.Delay)
 		time.Sleep(sv.Shutdown.Delay)
 	}
 
-	log("worker %s: sending %s", child, sv.Shutdown.Signal)
+	slog.Info("shutdown.signal", "worker", child.String(), "signal", sv.Shutdown.Signal)
+	start := time.Now()
 	child.Signal(sv.Shutdown.Signal.Syscall())
 	select {
 	case ps := <-child.Done:
 		sv.ec = process.ExitCode(ps)
+		mShutdowns.Observe(time.Since(start).Seconds(), "graceful")
 	case <-time.After(sv.Shutdown.Timeout):
-		log("worker %s: did not exit in %s, sending SIGKILL", child, sv.Shutdown.Timeout)
+		slog.Warn("shutdown.sigkill", "worker", child.String(), "timeout", sv.Shutdown.Timeout)
 		child.Kill()
 		<-child.Done
+		mShutdowns.Observe(time.Since(start).Seconds(), "killed")
 		// consider SIGKILL abnormal exit
 		sv.ec = 1
 	}
@@ -99,17 +120,26 @@ func (sv *supervisor) signal(ctx context.Context, child *process.Process) {
 	}
 }
 
-func (sv *supervisor) Start(ctx context.Context) error {
+func (sv *supervisor) Start(ctx context.Context, opts ...process.Option) error {
+	if err := sv.hook("preStart", sv.Hooks.PreStart); err != nil {
+		return failed(failHook, err)
+	}
+
 	// Start child process
-	env := figs.Stringify(sv.Env)
+	env := append(psflipEnv(), figs.Stringify(sv.Env)...)
 	child, err := process.Start(
 		figs.Stringify(sv.Cmd),
-		process.Env(env...),
-		process.Dir(sv.WorkDir.String()),
+		append([]process.Option{
+			process.Env(env...),
+			process.Dir(sv.WorkDir.String()),
+		}, opts...)...,
 	)
 	if err != nil {
 		return err
 	}
+	sv.pid.Store(int64(child.Pid))
+	mChildStarts.Inc()
+	slog.Info("worker.started", "worker", child.String())
 
 	// Proxy signals
 	go sv.signal(ctx, child)
@@ -121,6 +151,10 @@ func (sv *supervisor) Start(ctx context.Context) error {
 func (sv *supervisor) supervise(ctx context.Context, child *process.Process) (ec int) {
 	// Clean child process on exit
 	defer close(sv.exit)
+	defer func() {
+		mChildExits.Inc(strconv.Itoa(sv.ec))
+		sv.hook("postStop", sv.Hooks.PostStop, childEnv(child), "PSFLIP_EXIT_CODE="+strconv.Itoa(sv.ec))
+	}()
 	defer sv.cleanup(child)
 	defer func() {
 		if ec != -1 {
@@ -129,24 +163,35 @@ func (sv *supervisor) supervise(ctx context.Context, child *process.Process) (ec
 	}()
 
 	// Ensure we are healthy
+	start := time.Now()
 	select {
 	case <-time.After(sv.Upgrade.Timeout):
-		defer log("worker %s: unhealthy, did not settle after %s", child, sv.Upgrade.Timeout)
+		sv.err = failed(failTimeout, fmt.Errorf("child did not settle after %s", sv.Upgrade.Timeout))
+		defer slog.Error("worker.unhealthy", "worker", child.String(), "err", sv.err)
 		return 1
 	case ps := <-child.Done:
 		ec := process.ExitCode(ps)
-		log("worker %s: unhealthy, process exited with %d", child, ec)
+		sv.err = failed(failChildExited, fmt.Errorf("child exited with %d", ec))
+		slog.Error("worker.unhealthy", "worker", child.String(), "err", sv.err)
 		return max(ec, 1)
 	case err := <-sv.hc.Healthy(ctx):
+		observeHealthcheck("readiness", start, err)
 		if err != nil {
-			defer log("worker %s: unhealthy, healthchek failed: %v", child, err)
+			sv.err = failed(failHealthcheck, fmt.Errorf("healthcheck failed: %w", err))
+			defer slog.Error("worker.unhealthy", "worker", child.String(), "err", sv.err)
 			return 1
 		}
 	}
 
+	slog.Info("worker.healthy", "worker", child.String(), "after", time.Since(start))
+	mTimeToHealthy.Observe(time.Since(start).Seconds())
+	if err := sv.hook("postReady", sv.Hooks.PostReady, childEnv(child)); err != nil {
+		sv.err = failed(failHook, err)
+		return 1
+	}
+
 	// Signal we are ready
 	close(sv.ready)
-	log("worker %s healthy", child)
 
 	// exit on cancellation or on child exit
 	select {
@@ -156,7 +201,7 @@ func (sv *supervisor) supervise(ctx context.Context, child *process.Process) (ec
 	// Child exit: cleanup and proxy error code
 	case ps := <-child.Done:
 		ec = process.ExitCode(ps)
-		log("worker %s exited with %d, exiting", child, ec)
+		slog.Info("worker.exited", "worker", child.String(), "code", ec)
 		return ec
 	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/cloudflare/tableflip"
+	"github.com/mwek/psflip/pkg/healthcheck"
+	"github.com/mwek/psflip/pkg/systemd"
+)
+
+// watchdog pings the systemd watchdog while the child is alive and passes the liveness probe (if configured), so
+// that systemd restarts the unit when the child hangs. The probe runs right away on every tick.
+func watchdog(ctx context.Context, upg *tableflip.Upgrader, sv *supervisor) {
+	timeout, pid := systemd.WatchdogInterval()
+	// Upgraded psflip inherits the WATCHDOG_PID of the parent, and takes it over with MAINPID.
+	if timeout == 0 || (pid != 0 && pid != os.Getpid() && !upg.HasParent()) {
+		return
+	}
+	var probe healthcheck.Healthcheck
+	if config.Watchdog.Liveness != nil {
+		hc, err := healthcheck.New(*config.Watchdog.Liveness)
+		if err != nil {
+			slog.Error("watchdog.invalid_probe", "err", err)
+			return
+		}
+		probe = hc
+	}
+
+	interval := timeout / 2
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-sv.Exit():
+			return
+		case <-ctx.Done():
+			return
+		}
+		if probe != nil {
+			start := time.Now()
+			err := probe.Probe(ctx)
+			observeHealthcheck("liveness", start, err)
+			if err != nil {
+				slog.Warn("watchdog.probe_failed", "interval", interval, "err", err)
+				continue
+			}
+		}
+		notify(systemd.Watchdog)
+	}
+}
@@ -6,8 +6,11 @@ require (
 	github.com/cloudflare/tableflip v1.2.3
 	github.com/itchyny/timefmt-go v0.1.6
 	github.com/kkyr/fig v0.4.0
+	github.com/moby/moby/api v1.52.0-beta.4
+	github.com/moby/moby/client v0.1.0-beta.3
 	github.com/spf13/pflag v1.0.6
 	golang.org/x/sys v0.37.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -24,8 +27,6 @@ require (
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/moby/docker-image-spec v1.3.1 // indirect
-	github.com/moby/moby/api v1.52.0-beta.4 // indirect
-	github.com/moby/moby/client v0.1.0-beta.3 // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.1.1 // indirect
 	github.com/pelletier/go-toml/v2 v2.1.0 // indirect
@@ -39,5 +40,4 @@ require (
 	go.opentelemetry.io/otel/trace v1.35.0 // indirect
 	golang.org/x/net v0.46.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,49 @@
+package figs
+
+import (
+	"encoding"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/kkyr/fig"
+)
+
+// CIDR is an IP network, e.g. "10.0.0.0/8". A single IP address denotes a network with just that address.
+type CIDR netip.Prefix
+
+// CIDR implements fig.StringUnmarshaler
+func (c *CIDR) UnmarshalString(str string) error {
+	var prefix netip.Prefix
+	var err error
+	if strings.Contains(str, "/") {
+		prefix, err = netip.ParsePrefix(str)
+	} else {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(str)
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if err != nil {
+		return fmt.Errorf("invalid CIDR: %s", str)
+	}
+	*c = CIDR(prefix.Masked())
+	return nil
+}
+
+func (c CIDR) Prefix() netip.Prefix {
+	return netip.Prefix(c)
+}
+
+// CIDR implements fmt.Stringer
+func (c CIDR) String() string {
+	return c.Prefix().String()
+}
+
+// CIDR implements encoding.TextMarshaler
+func (c CIDR) MarshalText() ([]byte, error) {
+	return c.Prefix().MarshalText()
+}
+
+var _ fmt.Stringer = CIDR{}
+var _ encoding.TextMarshaler = CIDR{}
+var _ fig.StringUnmarshaler = (*CIDR)(nil)
@@ -0,0 +1,41 @@
+package figs
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/kkyr/fig"
+)
+
+// FileMode is a file permission, written in octal notation (e.g. "0660").
+type FileMode os.FileMode
+
+// FileMode implements fig.StringUnmarshaler
+func (m *FileMode) UnmarshalString(str string) error {
+	mode, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || mode > uint64(os.ModePerm) {
+		return fmt.Errorf("invalid file mode: %s", str)
+	}
+	*m = FileMode(mode)
+	return nil
+}
+
+func (m FileMode) FileMode() os.FileMode {
+	return os.FileMode(m)
+}
+
+// FileMode implements fmt.Stringer
+func (m FileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(m))
+}
+
+// FileMode implements encoding.TextMarshaler
+func (m FileMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+var _ fmt.Stringer = FileMode(0o660)
+var _ encoding.TextMarshaler = FileMode(0o660)
+var _ fig.StringUnmarshaler = (*FileMode)(nil)
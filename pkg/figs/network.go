@@ -1,6 +1,7 @@
 package figs
 
 import (
+	"encoding"
 	"fmt"
 	"strings"
 
@@ -36,6 +37,16 @@ func (na *NetworkAddr) UnmarshalString(str string) error {
 	switch network {
 	case "tcp", "tcp4", "tcp6", "unix", "unixpacket":
 		// Values supported by net.Listen: https://pkg.go.dev/net#Listen
+		// Linux abstract unix sockets are addressed with a leading "@".
+	case "udp", "udp4", "udp6", "unixgram":
+		// Values supported by net.ListenPacket: https://pkg.go.dev/net#ListenPacket
+	case "srv":
+		// DNS SRV record of a TCP service, e.g. "_http._tcp.example.com".
+	case "fd":
+		// Pre-opened file descriptor, by number or by name passed in LISTEN_FDNAMES.
+		if address == "" {
+			return fmt.Errorf("invalid file descriptor: %s", str)
+		}
 	default:
 		return fmt.Errorf("invalid network: %s", str)
 	}
@@ -43,11 +54,35 @@ func (na *NetworkAddr) UnmarshalString(str string) error {
 	return nil
 }
 
+// IsPacket reports whether the network is packet-oriented.
+func (na NetworkAddr) IsPacket() bool {
+	switch na.Network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	default:
+		return false
+	}
+}
+
+// IsFd reports whether the address is a pre-opened file descriptor.
+func (na NetworkAddr) IsFd() bool {
+	return na.Network == "fd"
+}
+
 // Network implements fmt.Stringer
 func (na NetworkAddr) String() string {
 	return fmt.Sprintf("%s://%s", na.Network, na.Address)
 }
 
+// Network implements encoding.TextMarshaler, leaving the empty address empty
+func (na NetworkAddr) MarshalText() ([]byte, error) {
+	if na.Network == "" {
+		return nil, nil
+	}
+	return []byte(na.String()), nil
+}
+
 // Compile-time check for interface implementation
 var _ fmt.Stringer = NetworkAddr{Network: "tcp", Address: "127.0.0.1:8080"}
+var _ encoding.TextMarshaler = NetworkAddr{}
 var _ fig.StringUnmarshaler = (*NetworkAddr)(nil)
@@ -1,6 +1,7 @@
 package figs
 
 import (
+	"encoding"
 	"fmt"
 	"strings"
 	"syscall"
@@ -42,5 +43,11 @@ func (s Signal) String() string {
 	return unix.SignalName(s.Syscall())
 }
 
+// Signal implements encoding.TextMarshaler
+func (s Signal) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
 var _ fmt.Stringer = Signal(syscall.SIGINT)
+var _ encoding.TextMarshaler = Signal(syscall.SIGINT)
 var _ fig.StringUnmarshaler = (*Signal)(nil)
@@ -5,6 +5,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -33,8 +34,12 @@ const (
 )
 
 var (
+	// mu guards abFlag and locals, changed by SetAB and Preview while other goroutines substitute
+	mu     sync.RWMutex
 	abFlag string
 	locals map[string]string
+	// startFlag is the AB flag this process started with
+	startFlag string
 )
 
 func init() {
@@ -45,6 +50,52 @@ func init() {
 		os.Setenv(abEnv, abA)
 		abFlag = abA
 	}
+	startFlag = abFlag
+}
+
+// ABFlags returns the values of the AB flag, alternating on each process upgrade.
+func ABFlags() []string {
+	return []string{abA, abB}
+}
+
+// ABFlag returns the AB flag of the substitutions, i.e. the one of this process unless overridden.
+func ABFlag() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return abFlag
+}
+
+// ABEnv returns the environment variable with the AB flag this process started with, e.g. to describe it to the
+// children. It is not affected by SetAB and Preview.
+func ABEnv() string {
+	return abEnv + "=" + startFlag
+}
+
+// SetAB overrides the AB flag for the following substitutions, e.g. to render the configuration after an upgrade.
+// It does not change the flag inherited by the upgraded process.
+func SetAB(flag string) {
+	mu.Lock()
+	defer mu.Unlock()
+	abFlag = flag
+}
+
+// Preview runs f with the AB flag of the upgraded process, e.g. to load its configuration in advance. The AB flag
+// and the locals are restored afterwards. Previews must not run concurrently, but may nest.
+func Preview(f func()) {
+	mu.Lock()
+	flag, saved := abFlag, locals
+	if abFlag == abA {
+		abFlag = abB
+	} else {
+		abFlag = abA
+	}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		abFlag, locals = flag, saved
+	}()
+	f()
 }
 
 func EnvDefault(key, def string) string {
@@ -55,13 +106,18 @@ func EnvDefault(key, def string) string {
 }
 
 func SetLocals[T fmt.Stringer](l map[string]T) {
-	locals = make(map[string]string, len(l))
+	m := make(map[string]string, len(l))
 	for k, v := range l {
-		locals[k] = v.String()
+		m[k] = v.String()
 	}
+	mu.Lock()
+	defer mu.Unlock()
+	locals = m
 }
 
 func GetLocal(name string) (string, error) {
+	mu.RLock()
+	defer mu.RUnlock()
 	if v, ok := locals[name]; ok {
 		return v, nil
 	} else {
@@ -71,13 +127,13 @@ func GetLocal(name string) (string, error) {
 
 // AB initially returns s1, and then alternates between s1 and s2 on each process upgrade.
 func AB(s1, s2 string) (string, error) {
-	switch abFlag {
+	switch flag := ABFlag(); flag {
 	case abA:
 		return s1, nil
 	case abB:
 		return s2, nil
 	default:
-		return "", fmt.Errorf("invalid PSFLIP_AB_FLAG value: %s", abFlag)
+		return "", fmt.Errorf("invalid PSFLIP_AB_FLAG value: %s", flag)
 	}
 }
 
@@ -20,6 +20,15 @@ func (a *Alive) Healthy(ctx context.Context) <-chan error {
 	return result
 }
 
+// Probe passes right away, as the child is alive.
+func (a *Alive) Probe(ctx context.Context) error {
+	return nil
+}
+
+func (a *Alive) ProbeTimeout() time.Duration {
+	return 0
+}
+
 func (a *Alive) check(ctx context.Context, result chan error) {
 	select {
 	case <-time.After(a.Timeout):
@@ -55,6 +55,20 @@ func (c *Command) check(ctx context.Context, result chan error) {
 	}
 }
 
+// Probe runs the command once, limited to the Interval.
+func (c *Command) Probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Interval)
+	defer cancel()
+	cmd := figs.Stringify(c.Cmd)
+	run := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	run.SysProcAttr = process.SysAttr()
+	return run.Run()
+}
+
+func (c *Command) ProbeTimeout() time.Duration {
+	return c.Interval
+}
+
 type runner struct {
 	mutex  sync.Mutex
 	result chan error
@@ -0,0 +1,73 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mwek/psflip/pkg/figs"
+)
+
+// Connect healthcheck assumes the child process healthy once the address accepts connections.
+// For packet networks, only the local part of the connection can be checked (e.g. the unixgram socket exists).
+type Connect struct {
+	Address  figs.NetworkAddr `validate:"required"`
+	After    time.Duration    `default:"0s"`
+	Interval time.Duration    `default:"1s"`
+}
+
+// compile-time check for interface implementation
+var _ Healthcheck = &Connect{}
+
+func (c *Connect) Healthy(ctx context.Context) <-chan error {
+	result := make(chan error, 1)
+	go c.check(ctx, result)
+	return result
+}
+
+// Probe connects to the address once, limited to the Interval.
+func (c *Connect) Probe(ctx context.Context) error {
+	if c.Address.IsFd() {
+		return fmt.Errorf("cannot connect to %s", c.Address)
+	}
+	d := net.Dialer{Timeout: c.Interval}
+	conn, err := d.DialContext(ctx, c.Address.Network, c.Address.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *Connect) ProbeTimeout() time.Duration {
+	return c.Interval
+}
+
+func (c *Connect) check(ctx context.Context, result chan error) {
+	if c.Address.IsFd() {
+		result <- fmt.Errorf("cannot connect to %s", c.Address)
+		return
+	}
+
+	// Wait for "After"
+	select {
+	case <-ctx.Done():
+		result <- errors.New("context cancelled")
+		return
+	case <-time.After(c.After):
+	}
+
+	for {
+		select {
+		case <-time.Tick(c.Interval):
+			if c.Probe(ctx) == nil {
+				result <- nil
+				return
+			}
+		case <-ctx.Done():
+			result <- errors.New("context cancelled")
+			return
+		}
+	}
+}
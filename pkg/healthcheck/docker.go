@@ -27,6 +27,37 @@ func (d *Docker) Healthy(ctx context.Context) <-chan error {
 	return result
 }
 
+// Probe inspects the container once, limited to the Interval, passing if it is healthy.
+func (d *Docker) Probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.Interval)
+	defer cancel()
+	c, err := client.New(client.WithHost(d.Socket.String()), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	containerID := d.Container.String()
+	status, err := c.ContainerInspect(ctx, containerID, client.ContainerInspectOptions{})
+	if err != nil {
+		return err
+	}
+	state := status.Container.State
+	switch {
+	case state == nil:
+		return fmt.Errorf("container %s has no state", containerID)
+	case state.Health == nil:
+		return fmt.Errorf("container %s has no healthcheck", containerID)
+	case state.Health.Status != container.Healthy:
+		return fmt.Errorf("container %s is %s", containerID, state.Health.Status)
+	}
+	return nil
+}
+
+func (d *Docker) ProbeTimeout() time.Duration {
+	return d.Interval
+}
+
 func (d *Docker) check(ctx context.Context, result chan error) {
 	c, err := client.New(client.WithHost(d.Socket.String()), client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/kkyr/fig"
 )
@@ -13,12 +14,17 @@ import (
 type Config struct {
 	Alive   *Alive
 	Command *Command
+	Connect *Connect
 	Docker  *Docker
 }
 
 // Healtcheck determines if the cmd is healthy
 type Healthcheck interface {
 	Healthy(ctx context.Context) <-chan error
+	// Probe checks once right away, e.g. for liveness, limited to the ProbeTimeout.
+	Probe(ctx context.Context) error
+	// ProbeTimeout is the longest a probe takes.
+	ProbeTimeout() time.Duration
 }
 
 // New returns the configured healthcheck. It errors when more than one config is present.
@@ -0,0 +1,229 @@
+// Package metrics implements a minimal registry of counters, gauges and histograms exposed in the Prometheus text
+// format: https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// Registry holds the metrics, written in the order of registration.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// family is a metric with its series, keyed by the label values.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *family {
+	f := &family{name, help, typ, labels, buckets, make(map[string]*series)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+// get returns the series of the label values. Must be called with the registry locked.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(values)}
+		if f.typ == histogramType {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	r *Registry
+	f *family
+}
+
+// Counter registers a new counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r, r.register(name, help, counterType, nil, labels)}
+}
+
+// Add increases the counter of the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.f.get(values).value += v
+}
+
+// Inc increases the counter of the label values by one.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	r *Registry
+	f *family
+}
+
+// Gauge registers a new gauge with the given label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r, r.register(name, help, gaugeType, nil, labels)}
+}
+
+// Set sets the gauge of the label values.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.get(values).value = v
+}
+
+// Histogram counts the observed values in buckets.
+type Histogram struct {
+	r *Registry
+	f *family
+}
+
+// Histogram registers a new histogram with the given upper bounds of the buckets and label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r, r.register(name, help, histogramType, slices.Sorted(slices.Values(buckets)), labels)}
+}
+
+// Observe records the value in the histogram of the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+	s := h.f.get(values)
+	for i, b := range h.f.buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// WriteTo writes all the metrics in the Prometheus text format.
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	w := &writer{}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		w.family(f.name, f.help, f.typ)
+		for _, key := range slices.Sorted(maps.Keys(f.series)) {
+			s := f.series[key]
+			pairs := labelPairs(f.labels, s.labels)
+			if f.typ != histogramType {
+				w.sample(f.name, s.value, pairs...)
+				continue
+			}
+			w.histogram(f.name, f.buckets, s.buckets, s.value, s.count, pairs...)
+		}
+	}
+	n, err := io.WriteString(out, w.sb.String())
+	return int64(n), err
+}
+
+// ServeHTTP implements http.Handler, serving the metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// writer formats the metrics in the Prometheus text format.
+type writer struct {
+	sb strings.Builder
+}
+
+// family writes the help and the type of the metric, to be followed by its samples.
+func (w *writer) family(name, help, typ string) {
+	fmt.Fprintf(&w.sb, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+// sample writes a single value with the label name and value pairs.
+func (w *writer) sample(name string, v float64, pairs ...string) {
+	w.sb.WriteString(name)
+	if len(pairs) > 0 {
+		w.sb.WriteByte('{')
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if i > 0 {
+				w.sb.WriteByte(',')
+			}
+			fmt.Fprintf(&w.sb, "%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1]))
+		}
+		w.sb.WriteByte('}')
+	}
+	w.sb.WriteByte(' ')
+	w.sb.WriteString(formatFloat(v))
+	w.sb.WriteByte('\n')
+}
+
+// histogram writes the cumulative counts of the buckets, the sum and the count of the observed values.
+func (w *writer) histogram(name string, bounds []float64, cumulative []uint64, sum float64, count uint64, pairs ...string) {
+	for i, b := range bounds {
+		w.sample(name+"_bucket", float64(cumulative[i]), append(slices.Clone(pairs), "le", formatFloat(b))...)
+	}
+	w.sample(name+"_bucket", float64(count), append(slices.Clone(pairs), "le", "+Inf")...)
+	w.sample(name+"_sum", sum, pairs...)
+	w.sample(name+"_count", float64(count), pairs...)
+}
+
+func labelPairs(names, values []string) []string {
+	pairs := make([]string, 0, 2*len(names))
+	for i, n := range names {
+		pairs = append(pairs, n, values[i])
+	}
+	return pairs
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
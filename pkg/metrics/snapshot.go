@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"slices"
+	"strings"
+)
+
+// Snapshot holds the counters and histograms of a registry by name, e.g. to carry them over to another process.
+// Gauges describe the current process only, and are left out.
+type Snapshot map[string][]Series
+
+// Series is the state of a counter or histogram for the label values.
+type Series struct {
+	Labels  []string `json:"labels,omitempty"`
+	Value   float64  `json:"value"`
+	Buckets []uint64 `json:"buckets,omitempty"`
+	Count   uint64   `json:"count,omitempty"`
+}
+
+// Snapshot returns the current state of the counters and histograms.
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snap := make(Snapshot)
+	for _, f := range r.families {
+		if f.typ == gaugeType {
+			continue
+		}
+		for _, s := range f.series {
+			snap[f.name] = append(snap[f.name], Series{slices.Clone(s.labels), s.value, slices.Clone(s.buckets), s.count})
+		}
+	}
+	return snap
+}
+
+// Merge adds the snapshot to the counters and histograms of the same name, label names and buckets.
+func (r *Registry) Merge(snap Snapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		if f.typ == gaugeType {
+			continue
+		}
+		for _, src := range snap[f.name] {
+			if len(src.Labels) != len(f.labels) || len(src.Buckets) != len(f.buckets) {
+				continue
+			}
+			s := f.get(src.Labels)
+			s.value += src.Value
+			s.count += src.Count
+			for i, b := range src.Buckets {
+				s.buckets[i] += b
+			}
+		}
+	}
+}
+
+// Sub returns the increase of the counters and histograms since the base snapshot, leaving out unchanged series.
+func (s Snapshot) Sub(base Snapshot) Snapshot {
+	delta := make(Snapshot)
+	for name, series := range s {
+		prev := make(map[string]Series, len(base[name]))
+		for _, b := range base[name] {
+			prev[strings.Join(b.Labels, "\xff")] = b
+		}
+		for _, cur := range series {
+			b, ok := prev[strings.Join(cur.Labels, "\xff")]
+			if !ok {
+				delta[name] = append(delta[name], cur)
+				continue
+			}
+			if cur.Value == b.Value && cur.Count == b.Count || len(cur.Buckets) != len(b.Buckets) {
+				continue
+			}
+			d := Series{Labels: cur.Labels, Value: cur.Value - b.Value, Count: cur.Count - b.Count}
+			for i := range cur.Buckets {
+				d.Buckets = append(d.Buckets, cur.Buckets[i]-b.Buckets[i])
+			}
+			delta[name] = append(delta[name], d)
+		}
+	}
+	return delta
+}
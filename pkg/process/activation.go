@@ -0,0 +1,76 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Environment of the systemd socket activation protocol: https://www.freedesktop.org/software/systemd/man/latest/sd_listen_fds.html
+const (
+	listenFdsEnv     = "LISTEN_FDS"
+	listenFdNamesEnv = "LISTEN_FDNAMES"
+	listenPidEnv     = "LISTEN_PID"
+
+	// shimEnv makes the process exec into the executable stored in the variable after setting LISTEN_PID.
+	shimEnv = "PSFLIP_LISTEN_SHIM"
+)
+
+// LISTEN_PID must match the PID of the activated process, which is unknown before it is started. The process is
+// thus started as a copy of the current executable, which sets LISTEN_PID to its PID and execs into the target.
+func init() {
+	executable, ok := os.LookupEnv(shimEnv)
+	if !ok {
+		return
+	}
+	env := slices.DeleteFunc(shimEnviron(), func(kv string) bool {
+		return strings.HasPrefix(kv, shimEnv+"=")
+	})
+	env = append(env, listenPidEnv+"="+strconv.Itoa(os.Getpid()))
+	err := syscall.Exec(executable, os.Args, env)
+	fmt.Fprintf(os.Stderr, "psflip: failed to exec %s: %v\n", executable, err)
+	os.Exit(127)
+}
+
+// shimEnviron returns the environment the shim was started with. Package initializers (e.g. the AB flag) may have
+// already modified os.Environ, so it is read from procfs when available.
+func shimEnviron() []string {
+	b, err := os.ReadFile("/proc/self/environ")
+	if err != nil {
+		return os.Environ()
+	}
+	return slices.DeleteFunc(strings.Split(string(b), "\x00"), func(kv string) bool {
+		return kv == ""
+	})
+}
+
+// deactivate removes the socket activation variables addressed to psflip from the environment.
+func deactivate(env []string) []string {
+	return slices.DeleteFunc(slices.Clone(env), func(kv string) bool {
+		return strings.HasPrefix(kv, listenFdsEnv+"=") ||
+			strings.HasPrefix(kv, listenFdNamesEnv+"=") ||
+			strings.HasPrefix(kv, listenPidEnv+"=")
+	})
+}
+
+// activate returns the executable and environment starting the process with sockets passed by socket activation.
+func activate(executable string, env []string, names []string) (string, []string, error) {
+	for _, name := range names {
+		if name == "" || strings.Contains(name, ":") {
+			return "", nil, fmt.Errorf("invalid socket name: %q", name)
+		}
+	}
+	shim, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+	env = append(env,
+		listenFdsEnv+"="+strconv.Itoa(len(names)),
+		listenFdNamesEnv+"="+strings.Join(names, ":"),
+		shimEnv+"="+executable,
+	)
+	return shim, env, nil
+}
@@ -5,12 +5,14 @@ import "os"
 type Option func(*options)
 
 type options struct {
-	env   []string
-	dir   string
-	files []*os.File
+	env     []string
+	dir     string
+	files   []*os.File
+	sockets []*os.File
+	names   []string
 }
 
-// Env passess extra environment to the process
+// Env passess extra environment to the process, replacing the inherited variables of the same name
 func Env(env ...string) Option {
 	return func(o *options) {
 		o.env = append(o.env, env...)
@@ -29,3 +31,11 @@ func Files(f ...*os.File) Option {
 		o.files = append(o.files, f...)
 	}
 }
+
+// Socket passes the listening socket to the process following the systemd socket activation protocol
+func Socket(name string, f *os.File) Option {
+	return func(o *options) {
+		o.sockets = append(o.sockets, f)
+		o.names = append(o.names, name)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"slices"
+	"strings"
 	"syscall"
 )
 
@@ -33,15 +34,24 @@ func Start(args []string, opts ...Option) (*Process, error) {
 		}
 	}
 
+	// Activated sockets must directly follow the standard streams
 	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
 	attr := &os.ProcAttr{
 		Dir:   dir,
-		Env:   slices.Concat(initialEnv, opt.env),
-		Files: slices.Concat(files, opt.files),
+		Env:   mergeEnv(deactivate(initialEnv), opt.env),
+		Files: slices.Concat(files, opt.sockets, opt.files),
 		Sys:   SysAttr(),
 	}
 
-	p, err := os.StartProcess(executable, args, attr)
+	start := executable
+	if len(opt.sockets) > 0 {
+		start, attr.Env, err = activate(executable, attr.Env, opt.names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := os.StartProcess(start, args, attr)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +70,20 @@ func Start(args []string, opts ...Option) (*Process, error) {
 	return c, nil
 }
 
+// mergeEnv appends the extra variables to the environment, replacing the inherited ones of the same name.
+func mergeEnv(env, extra []string) []string {
+	names := make(map[string]bool, len(extra))
+	for _, kv := range extra {
+		name, _, _ := strings.Cut(kv, "=")
+		names[name] = true
+	}
+	env = slices.DeleteFunc(env, func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return names[name]
+	})
+	return append(env, extra...)
+}
+
 type Process struct {
 	*os.Process
 	Name   string
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Close reasons reported by the access log.
+const (
+	reasonClientEOF = "client_eof"
+	reasonServerEOF = "server_eof"
+	reasonCopyError = "copy_error"
+	reasonDialError = "dial_error"
+	reasonIdle      = "idle_timeout"
+	reasonDrainCut  = "drain_cut"
+	reasonRejected  = "rejected"
+	reasonDenied    = "denied"
+	reasonRateLimit = "rate_limited"
+)
+
+// access records a proxied connection for the access log.
+type access struct {
+	start  time.Time
+	client string
+	target string
+	once   sync.Once
+	reason string
+	in     int64
+	out    int64
+}
+
+func newAccess(client string) *access {
+	return &access{start: time.Now(), client: client}
+}
+
+// close records the reason of closing the connection, keeping the first one.
+func (a *access) close(reason string) {
+	a.once.Do(func() {
+		a.reason = reason
+	})
+}
+
+// log writes the access log entry if enabled for the route.
+func (a *access) log(r *route) {
+	if !r.accessLog {
+		return
+	}
+	target := a.target
+	if target == "" {
+		target = r.network + "://" + r.dst
+	}
+	r.logger.Info("proxy.access", "listener", r.listen, "client", a.client, "target", target,
+		"duration", time.Since(a.start).Round(time.Millisecond), "in", a.in, "out", a.out, "reason", a.reason)
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import "net"
+
+// Conn is an end of a proxied connection. TCP and unix connections close their read and write sides independently;
+// other connections (e.g. TLS or protocol wrappers) fall back to closing the whole connection, which ends the
+// streams in both directions.
+type Conn struct {
+	net.Conn
+}
+
+// CloseRead closes the reading side of the connection, if supported.
+func (c Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+// CloseWrite signals the end of the stream to the peer, closing the whole connection if half-close is unsupported.
+func (c Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
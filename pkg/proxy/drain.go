@@ -0,0 +1,36 @@
+package proxy
+
+import "time"
+
+// drainGrace is the time between half-closing and force-closing the connections cut on drain.
+const drainGrace = time.Second
+
+// drain cuts the connection if it is still open after the timeout since the proxy stopped: first by half-closing
+// it, giving the peers drainGrace to finish, and then by closing it.
+func (tp *TCPProxy) drain(done <-chan struct{}, timeout time.Duration, halfClose, close func()) {
+	select {
+	case <-done:
+		return
+	case <-tp.ctx.Done():
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	tp.cut.Add(1)
+	halfClose()
+	select {
+	case <-done:
+	case <-time.After(drainGrace):
+		close()
+	}
+}
+
+// Drained returns the number of connections which were open when the proxy stopped, split into the ones closed
+// naturally and the ones cut after the drain timeout.
+func (tp *TCPProxy) Drained() (drained, cut int) {
+	c := int(tp.cut.Load())
+	return int(tp.pending.Load()) - c, c
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the rate limiter forgets the clients with full buckets.
+const sweepInterval = time.Minute
+
+// admit checks the client against the allow and deny lists and the rate limit. It returns the reason to reject the
+// client, or an empty string when it is admitted. Clients without an IP address (e.g. unix sockets) are always
+// admitted.
+func (r *route) admit(addr net.Addr) string {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return ""
+	}
+	for _, p := range r.deny {
+		if p.Contains(ip) {
+			return reasonDenied
+		}
+	}
+	if len(r.allow) > 0 && !containsIP(r.allow, ip) {
+		return reasonDenied
+	}
+	if r.limiter != nil && !r.limiter.allow(ip) {
+		return reasonRateLimit
+	}
+	return ""
+}
+
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP address of a TCP or UDP client.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	nip, ok := netip.AddrFromSlice(ip)
+	return nip.Unmap(), ok
+}
+
+// rateLimiter is a token bucket limiting new connections per client address.
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[netip.Addr]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(max(burst, 1)),
+		buckets:   make(map[netip.Addr]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the client's bucket, if available.
+func (rl *rateLimiter) allow(ip netip.Addr) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) >= sweepInterval {
+		rl.sweep(now)
+	}
+
+	b, ok := rl.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[ip] = b
+	}
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the clients whose buckets refilled, as they are equivalent to new clients.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for ip, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, ip)
+		}
+	}
+	rl.lastSweep = now
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// peekTimeout limits waiting for the client to send the host name.
+	peekTimeout = 10 * time.Second
+	// maxPeek is the largest beginning of the stream read for the host name.
+	maxPeek = 64 * 1024
+)
+
+// host routes the connections for a host name to a dedicated destination.
+type host struct {
+	name    string
+	network string
+	dst     string
+}
+
+// target returns the destination for the host name: an exact match, the first matching wildcard, or the route
+// destination.
+func (r *route) target(name string) (network, dst string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return r.network, r.dst
+	}
+	for _, h := range r.hosts {
+		if h.name == name {
+			return h.network, h.dst
+		}
+	}
+	for _, h := range r.hosts {
+		if suffix, ok := strings.CutPrefix(h.name, "*"); ok && strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return h.network, h.dst
+		}
+	}
+	return r.network, r.dst
+}
+
+// peekHost reads the beginning of the stream for the host name: the TLS SNI, or the HTTP Host header of the first
+// request. It returns the bytes read, to be replayed to the destination.
+func peekHost(c net.Conn) (string, []byte) {
+	c.SetReadDeadline(time.Now().Add(peekTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	var buf bytes.Buffer
+	br := bufio.NewReader(io.TeeReader(io.LimitReader(c, maxPeek), &buf))
+	first, err := br.Peek(1)
+	if err != nil {
+		return "", buf.Bytes()
+	}
+	// TLS handshake record
+	if first[0] == 0x16 {
+		return sniHost(br), buf.Bytes()
+	}
+	return httpHost(br), buf.Bytes()
+}
+
+// errPeeked stops the TLS handshake after reading the ClientHello.
+var errPeeked = errors.New("peeked")
+
+// sniHost returns the server name of the TLS ClientHello, without terminating TLS.
+func sniHost(r io.Reader) string {
+	var name string
+	tls.Server(peekConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errPeeked
+		},
+	}).Handshake()
+	return name
+}
+
+// httpHost returns the Host header of the HTTP request, without the port.
+func httpHost(r *bufio.Reader) string {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(req.Host); err == nil {
+		return h
+	}
+	return req.Host
+}
+
+// peekConn reads the TLS handshake from the reader, discarding the writes.
+type peekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (pc peekConn) Read(p []byte) (int, error) {
+	return pc.r.Read(p)
+}
+
+func (pc peekConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer calls a function once no activity is reported for the timeout.
+type idleTimer struct {
+	timer *time.Timer
+	last  atomic.Int64
+}
+
+// newIdleTimer returns the timer along with the function reporting the activity.
+func newIdleTimer(timeout time.Duration, f func()) (*idleTimer, func(int64)) {
+	it := &idleTimer{}
+	it.last.Store(time.Now().UnixNano())
+	it.timer = time.AfterFunc(timeout, func() {
+		idle := time.Since(time.Unix(0, it.last.Load()))
+		if idle >= timeout {
+			f()
+			return
+		}
+		it.timer.Reset(timeout - idle)
+	})
+	return it, func(int64) {
+		it.last.Store(time.Now().UnixNano())
+	}
+}
+
+func (it *idleTimer) Stop() {
+	it.timer.Stop()
+}
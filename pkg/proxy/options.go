@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+type Option func(*options)
+
+type options struct {
+	shadow       *Shadow
+	maxConns     int
+	reject       bool
+	dialTimeout  time.Duration
+	idleTimeout  time.Duration
+	keepAlive    time.Duration
+	delay        bool
+	drainTimeout time.Duration
+	logger       *slog.Logger
+	accessLog    bool
+	allow        []netip.Prefix
+	deny         []netip.Prefix
+	limiter      *rateLimiter
+	resolver     *resolver
+	hosts        []host
+}
+
+func newOptions(opts []Option) *options {
+	opt := options{logger: slog.Default()}
+	for _, o := range opts {
+		o(&opt)
+	}
+	return &opt
+}
+
+// Mirror duplicates the client-to-server stream of sampled connections through s
+func Mirror(s *Shadow) Option {
+	return func(o *options) {
+		o.shadow = s
+	}
+}
+
+// MaxConnections limits the number of concurrently proxied connections. Over the limit, new connections wait in the
+// listen backlog, or are closed right away with reject.
+func MaxConnections(n int, reject bool) Option {
+	return func(o *options) {
+		o.maxConns = n
+		o.reject = reject
+	}
+}
+
+// DialTimeout limits the time of connecting to the destination
+func DialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// IdleTimeout closes the connections without traffic in either direction for the given time
+func IdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = d
+	}
+}
+
+// KeepAlive sets the TCP keepalive period on both ends of the connection; negative disables the keepalives
+func KeepAlive(d time.Duration) Option {
+	return func(o *options) {
+		o.keepAlive = d
+	}
+}
+
+// NoDelay controls TCP_NODELAY on both ends of the connection, enabled by default
+func NoDelay(enabled bool) Option {
+	return func(o *options) {
+		o.delay = !enabled
+	}
+}
+
+// DrainTimeout cuts the connections still open after the given time since the proxy stopped
+func DrainTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.drainTimeout = d
+	}
+}
+
+// Logger sets the logger of the proxy errors and accesses, slog.Default() by default
+func Logger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// AccessLog logs every proxied connection when it closes
+func AccessLog() Option {
+	return func(o *options) {
+		o.accessLog = true
+	}
+}
+
+// Allow accepts only the clients within the given networks
+func Allow(prefixes ...netip.Prefix) Option {
+	return func(o *options) {
+		o.allow = append(o.allow, prefixes...)
+	}
+}
+
+// Deny rejects the clients within the given networks, taking precedence over Allow
+func Deny(prefixes ...netip.Prefix) Option {
+	return func(o *options) {
+		o.deny = append(o.deny, prefixes...)
+	}
+}
+
+// RateLimit limits the new connections per second from a single client address, allowing bursts of the given size
+func RateLimit(rate float64, burst int) Option {
+	return func(o *options) {
+		o.limiter = newRateLimiter(rate, burst)
+	}
+}
+
+// ResolveTTL caches the resolved addresses of the destination for the given time. By default, the destination is
+// resolved on every connection.
+func ResolveTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.resolver = &resolver{ttl: ttl}
+	}
+}
+
+// Host proxies the stream connections for the host name to another destination. The host name is taken from the TLS
+// SNI or the HTTP Host header of the first request; a leading "*." matches the subdomains.
+func Host(name, network, dst string) Option {
+	return func(o *options) {
+		o.hosts = append(o.hosts, host{strings.ToLower(name), network, dst})
+	}
+}
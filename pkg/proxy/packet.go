@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"cmp"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxPacket is the largest datagram relayed by the proxy.
+	maxPacket = 64 * 1024
+	// packetIdleTimeout ends a packet session without traffic in either direction, unless IdleTimeout is given.
+	packetIdleTimeout = 30 * time.Second
+)
+
+// AddPacket relays datagrams received on pc to the destination. Each client address gets a dedicated session
+// towards the destination, relaying the replies back to the client.
+func (tp *TCPProxy) AddPacket(pc net.PacketConn, network, dst string, opts ...Option) func() error {
+	r := tp.addRoute(pc.LocalAddr().String(), network, dst, opts)
+	tp.estWg.Add(1)
+	return func() error {
+		return tp.servePacket(pc, r)
+	}
+}
+
+func (tp *TCPProxy) servePacket(pc net.PacketConn, r *route) error {
+	defer tp.estWg.Done()
+	idle := cmp.Or(r.idleTimeout, packetIdleTimeout)
+
+	// Close the connection only after the sessions stop relaying replies.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sessions := make(map[string]net.Conn)
+	defer func() {
+		go func() {
+			wg.Wait()
+			pc.Close()
+		}()
+	}()
+
+	// Stop receiving when we are shutting down.
+	go func() {
+		<-tp.ctx.Done()
+		pc.SetReadDeadline(time.Now())
+	}()
+
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if tp.stopping() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		key := ""
+		if addr != nil {
+			key = addr.String()
+		}
+		mu.Lock()
+		d, ok := sessions[key]
+		if !ok {
+			// Filter the clients before dialing the destination.
+			r.accepted.Add(1)
+			if r.admit(addr) != "" {
+				r.refused.Add(1)
+				mu.Unlock()
+				continue
+			}
+			d, err = r.dial(tp.ctx, r.network, r.dst)
+			if err != nil {
+				r.dialFailures.Add(1)
+				mu.Unlock()
+				continue
+			}
+			sessions[key] = d
+			wg.Add(1)
+			tp.connWg.Add(1)
+			go func() {
+				defer tp.connWg.Done()
+				defer wg.Done()
+				r.active.Add(1)
+				defer r.active.Add(-1)
+				defer r.closed(time.Now())
+				if r.drainTimeout > 0 {
+					done := make(chan struct{})
+					defer close(done)
+					go tp.drain(done, r.drainTimeout, func() {}, func() { d.Close() })
+				}
+				relayReplies(pc, d, addr, idle, &r.out)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		d.SetReadDeadline(time.Now().Add(idle))
+		if n, err := d.Write(buf[:n]); err == nil {
+			r.in.Add(int64(n))
+		}
+	}
+}
+
+// relayReplies sends the datagrams received from the destination back to the client, until the session is idle.
+func relayReplies(pc net.PacketConn, d net.Conn, client net.Addr, idle time.Duration, out *atomic.Int64) {
+	defer d.Close()
+	buf := make([]byte, maxPacket)
+	for {
+		d.SetReadDeadline(time.Now().Add(idle))
+		n, err := d.Read(buf)
+		if err != nil {
+			return
+		}
+		// Unnamed unix datagram sockets cannot receive replies.
+		if client == nil || client.String() == "" {
+			continue
+		}
+		if n, err := pc.WriteTo(buf[:n], client); err == nil {
+			out.Add(int64(n))
+		}
+	}
+}
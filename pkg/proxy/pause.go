@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// gate pauses accepting new connections without closing the listeners, so that the pending connections stay in the
+// shared listen backlog for another process.
+type gate struct {
+	mu        sync.Mutex
+	paused    bool
+	listeners map[net.Listener]struct{}
+	// accepting is held for reading by every Accept in flight, and for writing while paused
+	accepting sync.RWMutex
+}
+
+// deadliner is implemented by the TCP and unix listeners.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// Pause stops accepting new connections on the stream listeners, including the ones added later, until resumed. It
+// returns once no listener accepts new connections. Packet listeners keep accepting new sessions.
+func (tp *TCPProxy) Pause() {
+	g := &tp.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return
+	}
+	g.paused = true
+	// Interrupt the Accept in flight.
+	for l := range g.listeners {
+		if d, ok := l.(deadliner); ok {
+			d.SetDeadline(time.Now())
+		}
+	}
+	g.accepting.Lock()
+}
+
+// Resume accepts new connections again after Pause.
+func (tp *TCPProxy) Resume() {
+	g := &tp.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return
+	}
+	g.paused = false
+	for l := range g.listeners {
+		if d, ok := l.(deadliner); ok {
+			d.SetDeadline(time.Time{})
+		}
+	}
+	g.accepting.Unlock()
+}
+
+// track registers the listener to be interrupted by Pause, returning the func to unregister it.
+func (g *gate) track(l net.Listener) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.listeners == nil {
+		g.listeners = make(map[net.Listener]struct{})
+	}
+	g.listeners[l] = struct{}{}
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.listeners, l)
+	}
+}
+
+// accept waits for the next connection unless paused.
+func (g *gate) accept(l net.Listener) (net.Conn, error) {
+	g.accepting.RLock()
+	defer g.accepting.RUnlock()
+	return l.Accept()
+}
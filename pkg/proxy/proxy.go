@@ -4,18 +4,12 @@ import (
 	"context"
 	"errors"
 	"io"
-	"log"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 )
 
-// connRW allows to close the read and write sides of a connection.
-type connRW interface {
-	CloseRead() error
-	CloseWrite() error
-}
-
 var ErrServerClosed = errors.New("proxy: Server closed")
 
 type TCPProxy struct {
@@ -24,6 +18,17 @@ type TCPProxy struct {
 	stop   atomic.Bool
 	estWg  sync.WaitGroup
 	connWg sync.WaitGroup
+
+	// active connections, the ones pending when stopped, and the ones cut on drain
+	active  atomic.Int64
+	pending atomic.Int64
+	cut     atomic.Int64
+
+	gate gate
+
+	// routes of the listeners, for Stats
+	mu     sync.Mutex
+	routes []*route
 }
 
 func New() *TCPProxy {
@@ -39,7 +44,14 @@ func New() *TCPProxy {
 
 func (tp *TCPProxy) Stop() {
 	tp.stop.Store(true)
+	tp.pending.Store(tp.active.Load())
+	tp.mu.Lock()
+	for _, r := range tp.routes {
+		r.openAtDrain.Store(r.active.Load())
+	}
+	tp.mu.Unlock()
 	tp.cancel()
+	tp.Resume()
 	tp.estWg.Wait()
 }
 
@@ -51,16 +63,36 @@ func (tp *TCPProxy) stopping() bool {
 	return tp.stop.Load()
 }
 
-func (tp *TCPProxy) Add(l net.Listener, network, dst string) func() error {
+// route describes where the connections accepted by a listener are proxied to.
+type route struct {
+	listen  string
+	network string
+	dst     string
+	*options
+	counters
+}
+
+// addRoute registers the route of a new listener.
+func (tp *TCPProxy) addRoute(listen, network, dst string, opts []Option) *route {
+	r := &route{listen: listen, network: network, dst: dst, options: newOptions(opts)}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.routes = append(tp.routes, r)
+	return r
+}
+
+func (tp *TCPProxy) Add(l net.Listener, network, dst string, opts ...Option) func() error {
+	r := tp.addRoute(l.Addr().String(), network, dst, opts)
 	tp.estWg.Add(1)
 	return func() error {
-		return tp.serve(l, network, dst)
+		return tp.serve(l, r)
 	}
 }
 
-func (tp *TCPProxy) serve(l net.Listener, network, dst string) error {
+func (tp *TCPProxy) serve(l net.Listener, r *route) error {
 	defer l.Close()
 	defer tp.estWg.Done()
+	defer tp.gate.track(l)()
 
 	// Shutdown the listener when we are shutting down.
 	go func() {
@@ -68,36 +100,136 @@ func (tp *TCPProxy) serve(l net.Listener, network, dst string) error {
 		l.Close()
 	}()
 
+	// Limit concurrent connections.
+	var slots chan struct{}
+	if r.maxConns > 0 {
+		slots = make(chan struct{}, r.maxConns)
+	}
+
 	for {
-		conn, err := l.Accept()
+		// Queue: leave new connections in the listen backlog until a slot frees up.
+		if slots != nil && !r.reject {
+			select {
+			case slots <- struct{}{}:
+			case <-tp.ctx.Done():
+				return ErrServerClosed
+			}
+		}
+
+		conn, err := tp.gate.accept(l)
 		if err != nil {
 			if tp.stopping() {
 				return ErrServerClosed
 			}
+			// Interrupted by Pause.
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if slots != nil && !r.reject {
+					<-slots
+				}
+				continue
+			}
 			return err
 		}
+		r.accepted.Add(1)
+
+		// Filter the clients before dialing the destination.
+		if reason := r.admit(conn.RemoteAddr()); reason != "" {
+			r.refuse(conn, reason)
+			if slots != nil && !r.reject {
+				<-slots
+			}
+			continue
+		}
+
+		// Reject: close new connections right away.
+		if slots != nil && r.reject {
+			select {
+			case slots <- struct{}{}:
+			default:
+				r.refuse(conn, reasonRejected)
+				continue
+			}
+		}
 
 		tp.connWg.Add(1)
-		go tp.proxyConn(conn, network, dst)
+		go func() {
+			tp.proxyConn(conn, r)
+			if slots != nil {
+				<-slots
+			}
+		}()
 	}
 }
 
-func (tp *TCPProxy) proxyConn(src net.Conn, network, dst string) {
+// refuse closes the connection without proxying it.
+func (r *route) refuse(conn net.Conn, reason string) {
+	r.refused.Add(1)
+	a := newAccess(conn.RemoteAddr().String())
+	a.close(reason)
+	a.log(r)
+	conn.Close()
+}
+
+func (tp *TCPProxy) proxyConn(src net.Conn, r *route) {
 	defer tp.connWg.Done()
 	defer src.Close()
+	setTCPOptions(src, r.options)
 
-	d, err := net.Dial(network, dst)
+	a := newAccess(src.RemoteAddr().String())
+	defer a.log(r)
+
+	// Route by the host name, replaying the bytes read for it.
+	network, dst := r.network, r.dst
+	var peeked []byte
+	if len(r.hosts) > 0 {
+		var name string
+		name, peeked = peekHost(src)
+		network, dst = r.target(name)
+		a.target = network + "://" + dst
+	}
+
+	d, err := r.dial(tp.ctx, network, dst)
 	if err != nil {
+		a.close(reasonDialError)
+		r.dialFailures.Add(1)
+		if dnsErr := (*net.DNSError)(nil); errors.As(err, &dnsErr) {
+			r.logger.Warn("proxy.resolve_failed", "target", network+"://"+dst, "err", err)
+		}
 		return
 	}
 	defer d.Close()
+	setTCPOptions(d, r.options)
 
-	// We only support TCPConn and UnixConn. Both implement the connRW interface.
-	if _, ok := src.(connRW); !ok {
-		panic("source connection does not support CloseRead and CloseWrite")
+	tp.active.Add(1)
+	defer tp.active.Add(-1)
+	r.active.Add(1)
+	defer r.active.Add(-1)
+	defer r.closed(a.start)
+
+	// Cut the connection if it does not finish within the drain timeout.
+	if r.drainTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go tp.drain(done, r.drainTimeout, func() {
+			a.close(reasonDrainCut)
+			Conn{src}.CloseWrite()
+			Conn{d}.CloseWrite()
+		}, func() {
+			src.Close()
+			d.Close()
+		})
 	}
-	if _, ok := d.(connRW); !ok {
-		panic("destination connection does not support CloseRead and CloseWrite")
+
+	// Close the connection once it is idle in both directions.
+	var touch func(int64)
+	if r.idleTimeout > 0 {
+		var idle *idleTimer
+		idle, touch = newIdleTimer(r.idleTimeout, func() {
+			a.close(reasonIdle)
+			src.Close()
+			d.Close()
+		})
+		defer idle.Stop()
 	}
 
 	// Copy data between source and destination. The destination is responsible for gracefully closing the connection.
@@ -105,18 +237,87 @@ func (tp *TCPProxy) proxyConn(src net.Conn, network, dst string) {
 	// connection after psflip exits.
 	wg := sync.WaitGroup{}
 	wg.Add(2)
-	var stream = func(src, dst net.Conn) {
+	var stream = func(src, dst Conn, w io.Writer, written *int64, total *atomic.Int64, eof string) {
 		defer wg.Done()
-		srcRW := src.(connRW)
-		dstRW := dst.(connRW)
-		defer srcRW.CloseRead()
-		defer dstRW.CloseWrite()
-		n, err := io.Copy(dst, src)
+		defer src.CloseRead()
+		defer dst.CloseWrite()
+		n, err := copyStream(w, src.Conn, func(n int64) {
+			total.Add(n)
+			if touch != nil {
+				touch(n)
+			}
+		})
+		*written += n
+		switch {
+		case err == nil:
+			a.close(eof)
+		// Closed connections are expected when falling back to the full close.
+		case !errors.Is(err, net.ErrClosed):
+			a.close(reasonCopyError)
+			r.logger.Warn("proxy.copy_failed", "listener", r.listen, "bytes", n, "err", err)
+		}
+	}
+	// Mirror the client-to-server stream if the connection is sampled for shadowing.
+	var upstream io.Writer = d
+	if m := r.shadow.mirror(); m != nil {
+		defer m.Close()
+		upstream = io.MultiWriter(d, m)
+	}
+	if len(peeked) > 0 {
+		n, err := upstream.Write(peeked)
+		a.in += int64(n)
+		r.in.Add(int64(n))
 		if err != nil {
-			log.Printf("error copying data after %d bytes: %v", n, err)
+			a.close(reasonCopyError)
+			return
 		}
 	}
-	go stream(d, src)
-	go stream(src, d)
+	go stream(Conn{d}, Conn{src}, src, &a.out, &r.out, reasonServerEOF)
+	go stream(Conn{src}, Conn{d}, upstream, &a.in, &r.in, reasonClientEOF)
 	wg.Wait()
 }
+
+// copyStream copies data from src to dst, moving it directly between the sockets with splice(2) when possible.
+// The progress (if not nil) is called with the number of bytes after every write.
+func copyStream(dst io.Writer, src net.Conn, progress func(int64)) (int64, error) {
+	if progress == nil {
+		// net.TCPConn splices on its own
+		return io.Copy(dst, src)
+	}
+	if d, ok := dst.(net.Conn); ok {
+		if n, handled, err := splice(d, src, progress); handled {
+			return n, err
+		}
+	}
+	// Hide io.ReaderFrom and io.WriterTo, which copy without reporting the progress.
+	return io.Copy(progressWriter{dst, progress}, struct{ io.Reader }{src})
+}
+
+// progressWriter reports the number of bytes written.
+type progressWriter struct {
+	io.Writer
+	progress func(int64)
+}
+
+func (pw progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.Writer.Write(p)
+	if pw.progress != nil && n > 0 {
+		pw.progress(int64(n))
+	}
+	return n, err
+}
+
+// setTCPOptions applies keepalive and TCP_NODELAY settings to TCP connections.
+func setTCPOptions(c net.Conn, opt *options) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if opt.keepAlive < 0 {
+		tc.SetKeepAlive(false)
+	} else if opt.keepAlive > 0 {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(opt.keepAlive)
+	}
+	tc.SetNoDelay(!opt.delay)
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// failedTTL caches the failed lookups, so that an unavailable DNS server is not queried on every connection.
+const failedTTL = time.Second
+
+// resolver caches the addresses of the destinations for the TTL, so that they are re-resolved periodically rather
+// than on every connection. Concurrent connections share the lookup in flight, and a failed lookup keeps serving the
+// addresses resolved before.
+type resolver struct {
+	ttl   time.Duration
+	mu    sync.Mutex
+	cache map[string]*resolved
+}
+
+type resolved struct {
+	addrs []string
+	err   error
+	exp   time.Time
+	// done is closed once the lookup in flight completes, nil if none
+	done chan struct{}
+}
+
+// dial connects to the destination. Host names are re-resolved on every connection unless cached by the resolver;
+// "srv" destinations are looked up as DNS SRV records and dialed over TCP.
+func (r *route) dial(ctx context.Context, network, dst string) (net.Conn, error) {
+	addrs, err := r.resolve(ctx, network, dst)
+	if network == "srv" {
+		network = "tcp"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{Timeout: r.dialTimeout, KeepAlive: r.keepAlive}
+	var errs []error
+	for _, addr := range addrs {
+		c, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// resolve returns the addresses to dial, in order of preference.
+func (r *route) resolve(ctx context.Context, network, dst string) ([]string, error) {
+	if network != "srv" && (r.resolver == nil || !resolvable(dst)) {
+		return []string{dst}, nil
+	}
+
+	lookup := lookupHost
+	if network == "srv" {
+		lookup = lookupSRV
+	}
+	if r.resolver == nil {
+		return lookup(ctx, dst)
+	}
+	return r.resolver.resolve(ctx, network+"://"+dst, func(ctx context.Context) ([]string, error) {
+		return lookup(ctx, dst)
+	})
+}
+
+// resolve returns the cached addresses of the key, looking them up once expired.
+func (rs *resolver) resolve(ctx context.Context, key string, lookup func(context.Context) ([]string, error)) ([]string, error) {
+	rs.mu.Lock()
+	if rs.cache == nil {
+		rs.cache = make(map[string]*resolved)
+	}
+	c, ok := rs.cache[key]
+	if !ok {
+		c = &resolved{}
+		rs.cache[key] = c
+	}
+	if time.Now().Before(c.exp) {
+		defer rs.mu.Unlock()
+		return c.addrs, c.err
+	}
+	if done := c.done; done != nil {
+		rs.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		return c.addrs, c.err
+	}
+	done := make(chan struct{})
+	c.done = done
+	rs.mu.Unlock()
+
+	// The lookup is shared with the waiting connections, and outlives the connection starting it
+	addrs, err := lookup(context.WithoutCancel(ctx))
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	switch {
+	case err == nil:
+		c.addrs, c.err, c.exp = addrs, nil, time.Now().Add(rs.ttl)
+	case len(c.addrs) > 0:
+		// Keep the stale addresses, retrying shortly
+		c.err, c.exp = nil, time.Now().Add(min(rs.ttl, failedTTL))
+	default:
+		c.err, c.exp = err, time.Now().Add(min(rs.ttl, failedTTL))
+	}
+	c.done = nil
+	close(done)
+	return c.addrs, c.err
+}
+
+// resolvable reports whether the address contains a host name rather than an IP address.
+func resolvable(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && host != "" && net.ParseIP(host) == nil
+}
+
+func lookupHost(ctx context.Context, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+// lookupSRV returns the SRV targets, sorted by priority and randomized by weight.
+func lookupSRV(ctx context.Context, name string) ([]string, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(srvs))
+	for i, srv := range srvs {
+		addrs[i] = net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port)))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shadowBuffer is the number of writes queued for the shadow destination before the mirror is dropped.
+const shadowBuffer = 64
+
+// shadowDialTimeout limits connecting to the shadow destination; the writes are queued meanwhile.
+const shadowDialTimeout = 5 * time.Second
+
+// Shadow mirrors the client-to-server stream of sampled connections to a secondary destination, discarding its
+// responses. The zero value is a stopped Shadow.
+type Shadow struct {
+	target atomic.Pointer[shadowTarget]
+	mu     sync.Mutex
+	open   map[*mirror]struct{}
+}
+
+type shadowTarget struct {
+	network string
+	address string
+	sample  float64
+}
+
+// Start mirrors the given fraction of new connections to the destination.
+func (s *Shadow) Start(network, address string, sample float64) {
+	s.target.Store(&shadowTarget{network, address, sample})
+}
+
+// Stop prevents any new connections from being mirrored, and drops the mirrors of the open connections.
+func (s *Shadow) Stop() {
+	s.target.Store(nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for m := range s.open {
+		m.drop()
+	}
+}
+
+// mirror returns a writer for a sampled connection, or nil when the connection should not be mirrored.
+func (s *Shadow) mirror() *mirror {
+	if s == nil {
+		return nil
+	}
+	t := s.target.Load()
+	if t == nil || rand.Float64() >= t.sample {
+		return nil
+	}
+	m := &mirror{
+		shadow: s,
+		ch:     make(chan []byte, shadowBuffer),
+	}
+	s.mu.Lock()
+	if s.open == nil {
+		s.open = make(map[*mirror]struct{})
+	}
+	s.open[m] = struct{}{}
+	s.mu.Unlock()
+	go m.forward(t.network, t.address)
+	return m
+}
+
+func (s *Shadow) forget(m *mirror) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.open, m)
+}
+
+// mirror never blocks nor fails the proxied stream: if the shadow destination is slow or broken, it is dropped.
+type mirror struct {
+	shadow  *Shadow
+	ch      chan []byte
+	dropped atomic.Bool
+	once    sync.Once
+	mu      sync.Mutex
+	conn    net.Conn
+}
+
+func (m *mirror) Write(p []byte) (int, error) {
+	if m.dropped.Load() {
+		return len(p), nil
+	}
+	select {
+	case m.ch <- append([]byte(nil), p...):
+	default:
+		m.drop()
+	}
+	return len(p), nil
+}
+
+// Close flushes the queued writes and closes the shadow connection.
+func (m *mirror) Close() error {
+	m.once.Do(func() { close(m.ch) })
+	return nil
+}
+
+// drop discards the following writes, closing the shadow connection.
+func (m *mirror) drop() {
+	m.dropped.Store(true)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+// forward connects to the shadow destination in the background, and writes the queued data to it.
+func (m *mirror) forward(network, address string) {
+	defer m.shadow.forget(m)
+	d := net.Dialer{Timeout: shadowDialTimeout}
+	conn, err := d.Dial(network, address)
+	if err != nil {
+		m.dropped.Store(true)
+	} else {
+		defer conn.Close()
+		m.mu.Lock()
+		m.conn = conn
+		m.mu.Unlock()
+		if m.dropped.Load() {
+			conn.Close()
+		}
+		go io.Copy(io.Discard, conn)
+	}
+	for b := range m.ch {
+		if m.dropped.Load() {
+			continue
+		}
+		if _, err := conn.Write(b); err != nil {
+			m.dropped.Store(true)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceSize is the largest chunk moved by a single splice(2) call, matching the default pipe capacity.
+const spliceSize = 64 * 1024
+
+// splice copies data from src to dst through a pipe with splice(2), without copying it into userspace.
+// It reports handled=false if the connections do not expose their file descriptors.
+//
+// net.TCPConn splices on its own in ReadFrom and WriteTo, but reports the bytes only once the stream ends; this
+// copy exists to call progress after every chunk, which keeps the statistics and the idle timeout up to date.
+func splice(dst, src net.Conn, progress func(int64)) (written int64, handled bool, err error) {
+	srcRc, ok := rawConn(src)
+	if !ok {
+		return 0, false, nil
+	}
+	dstRc, ok := rawConn(dst)
+	if !ok {
+		return 0, false, nil
+	}
+
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	for {
+		// Move data from the source into the pipe. The pipe is always empty here, so EAGAIN comes from the source.
+		var n int64
+		var serr error
+		err = srcRc.Read(func(fd uintptr) bool {
+			n, serr = spliceRetry(int(fd), p[1])
+			return serr != unix.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil || n == 0 {
+			return written, true, err
+		}
+
+		// Drain the pipe into the destination. The pipe holds data here, so EAGAIN comes from the destination.
+		for n > 0 {
+			var m int64
+			err = dstRc.Write(func(fd uintptr) bool {
+				m, serr = spliceRetry(p[0], int(fd))
+				return serr != unix.EAGAIN
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				return written, true, err
+			}
+			n -= m
+			written += m
+			if progress != nil {
+				progress(m)
+			}
+		}
+	}
+}
+
+// spliceRetry moves up to spliceSize bytes between the descriptors, retrying on interrupts.
+func spliceRetry(rfd, wfd int) (int64, error) {
+	for {
+		n, err := unix.Splice(rfd, nil, wfd, nil, spliceSize, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		if err != unix.EINTR {
+			return n, err
+		}
+	}
+}
+
+func rawConn(c net.Conn) (syscall.RawConn, bool) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	return rc, true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// splice(2) is only supported on Linux
+func splice(dst, src net.Conn, progress func(int64)) (written int64, handled bool, err error) {
+	return 0, false, nil
+}
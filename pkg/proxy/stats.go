@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// DurationBuckets are the upper bounds of the connection duration histogram.
+var DurationBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+// Stats are the counters of a single listener since the proxy started. Packet listeners count the sessions of the
+// client addresses as connections.
+type Stats struct {
+	// Listen is the address of the listener.
+	Listen string
+	// Target is the destination of the connections.
+	Target string
+	// Accepted counts the connections accepted by the listener, including the refused ones.
+	Accepted int64
+	// Refused counts the connections rejected over the limit, denied, or rate limited.
+	Refused int64
+	// Active is the number of connections being proxied.
+	Active int64
+	// DialFailures counts the failures of connecting or resolving the destination.
+	DialFailures int64
+	// BytesIn and BytesOut count the data sent to and received from the destination.
+	BytesIn  int64
+	BytesOut int64
+	// Durations counts the closed connections by duration: Durations[i] counts the connections not longer than
+	// DurationBuckets[i], and the last element the longer ones.
+	Durations [len(DurationBuckets) + 1]int64
+	// OpenAtDrain is the number of connections still open when the proxy stopped.
+	OpenAtDrain int64
+}
+
+// LogValue implements slog.LogValuer, logging the stats as a group.
+func (s Stats) LogValue() slog.Value {
+	hist := make([]slog.Attr, len(s.Durations))
+	for i, n := range s.Durations {
+		if i < len(DurationBuckets) {
+			hist[i] = slog.Int64(DurationBuckets[i].String(), n)
+		} else {
+			hist[i] = slog.Int64("+Inf", n)
+		}
+	}
+	return slog.GroupValue(
+		slog.String("listener", s.Listen),
+		slog.String("target", s.Target),
+		slog.Int64("accepted", s.Accepted),
+		slog.Int64("refused", s.Refused),
+		slog.Int64("active", s.Active),
+		slog.Int64("dial_failures", s.DialFailures),
+		slog.Int64("in", s.BytesIn),
+		slog.Int64("out", s.BytesOut),
+		slog.Attr{Key: "durations", Value: slog.GroupValue(hist...)},
+		slog.Int64("open_at_drain", s.OpenAtDrain),
+	)
+}
+
+// counters are updated concurrently by the connections of a route.
+type counters struct {
+	accepted     atomic.Int64
+	refused      atomic.Int64
+	active       atomic.Int64
+	dialFailures atomic.Int64
+	in           atomic.Int64
+	out          atomic.Int64
+	durations    [len(DurationBuckets) + 1]atomic.Int64
+	openAtDrain  atomic.Int64
+}
+
+// closed records the duration of a closed connection.
+func (c *counters) closed(start time.Time) {
+	d := time.Since(start)
+	i := 0
+	for i < len(DurationBuckets) && d > DurationBuckets[i] {
+		i++
+	}
+	c.durations[i].Add(1)
+}
+
+// Stats returns the counters of every listener, in the order of adding them.
+func (tp *TCPProxy) Stats() []Stats {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	stats := make([]Stats, len(tp.routes))
+	for i, r := range tp.routes {
+		c := &r.counters
+		s := Stats{
+			Listen:       r.listen,
+			Target:       fmt.Sprintf("%s://%s", r.network, r.dst),
+			Accepted:     c.accepted.Load(),
+			Refused:      c.refused.Load(),
+			Active:       c.active.Load(),
+			DialFailures: c.dialFailures.Load(),
+			BytesIn:      c.in.Load(),
+			BytesOut:     c.out.Load(),
+			OpenAtDrain:  c.openAtDrain.Load(),
+		}
+		for j := range c.durations {
+			s.Durations[j] = c.durations[j].Load()
+		}
+		stats[i] = s
+	}
+	return stats
+}
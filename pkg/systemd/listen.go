@@ -0,0 +1,57 @@
+package systemd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Environment of the socket activation protocol: https://www.freedesktop.org/software/systemd/man/latest/sd_listen_fds.html
+const (
+	listenFdsEnv     = "LISTEN_FDS"
+	listenFdNamesEnv = "LISTEN_FDNAMES"
+	listenPidEnv     = "LISTEN_PID"
+
+	// listenFdsStart is the first file descriptor passed by systemd.
+	listenFdsStart = 3
+)
+
+// Socket is a file descriptor passed by systemd socket activation, named after LISTEN_FDNAMES.
+type Socket struct {
+	*os.File
+	// Fd is the number of the passed file descriptor.
+	Fd int
+}
+
+// Sockets returns the sockets passed to the current process by systemd socket activation. The activation
+// environment is unset, so that it does not leak to the child processes.
+func Sockets() []Socket {
+	defer func() {
+		os.Unsetenv(listenFdsEnv)
+		os.Unsetenv(listenFdNamesEnv)
+		os.Unsetenv(listenPidEnv)
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv(listenPidEnv))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv(listenFdsEnv))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv(listenFdNamesEnv), ":")
+
+	sockets := make([]Socket, 0, n)
+	for i := range n {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		sockets = append(sockets, Socket{os.NewFile(uintptr(fd), name), fd})
+	}
+	return sockets
+}
@@ -0,0 +1,63 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Environment of the notification protocol: https://www.freedesktop.org/software/systemd/man/latest/sd_notify.html
+const (
+	notifySocketEnv = "NOTIFY_SOCKET"
+	watchdogUsecEnv = "WATCHDOG_USEC"
+	watchdogPidEnv  = "WATCHDOG_PID"
+)
+
+// States sent to the service manager.
+const (
+	Ready     = "READY=1"
+	Reloading = "RELOADING=1"
+	Watchdog  = "WATCHDOG=1"
+)
+
+// MainPid returns the state telling the service manager about the new main process.
+func MainPid(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
+
+// Monotonic returns the state with the current CLOCK_MONOTONIC time, required along RELOADING=1.
+func Monotonic() string {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return "MONOTONIC_USEC=" + strconv.FormatInt(ts.Nano()/1000, 10)
+}
+
+// WatchdogInterval returns the timeout of the service watchdog, or zero if disabled, and the PID expected to send
+// the pings, or zero if any.
+func WatchdogInterval() (timeout time.Duration, pid int) {
+	usec, err := strconv.ParseInt(os.Getenv(watchdogUsecEnv), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, 0
+	}
+	pid, _ = strconv.Atoi(os.Getenv(watchdogPidEnv))
+	return time.Duration(usec) * time.Microsecond, pid
+}
+
+// Notify sends the states to the service manager. It does nothing when not run by systemd.
+func Notify(states ...string) error {
+	socket := os.Getenv(notifySocketEnv)
+	if socket == "" {
+		return nil
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
@@ -0,0 +1,184 @@
+// Benchmark of the proxy throughput and CPU usage, comparing the psflip proxy with plain io.Copy between the TCP
+// connections (which splices on Linux, but without reporting the progress).
+//
+// Usage: go run ./tests/bench [--size BYTES] [--conns N]
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	tcpproxy "github.com/mwek/psflip/pkg/proxy"
+	flag "github.com/spf13/pflag"
+)
+
+var (
+	size    = flag.Int64("size", 1<<30, "bytes sent over each connection")
+	conns   = flag.Int("conns", 4, "number of parallel connections")
+	role    = flag.String("role", "", "internal: run as the proxy process")
+	forward = flag.String("forward", "", "internal: address the proxy forwards to")
+	mode    = flag.String("mode", "psflip", "internal: proxy with psflip or io.Copy")
+)
+
+func main() {
+	flag.Parse()
+	if *role == "proxy" {
+		runProxy()
+		return
+	}
+
+	fmt.Printf("%-10s %12s %10s %12s\n", "mode", "throughput", "cpu", "cpu/GiB")
+	for _, mode := range []string{"io.Copy", "psflip"} {
+		if err := bench(mode); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", mode, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// runProxy proxies connections until SIGTERM, printing the listening address on stdout.
+func runProxy() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(l.Addr())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	if *mode == "io.Copy" {
+		go copyProxy(l, *forward)
+		<-sig
+		return
+	}
+	proxy := tcpproxy.New()
+	go proxy.Add(l, "tcp", *forward)()
+	<-sig
+	proxy.Stop()
+	proxy.Wait()
+}
+
+// copyProxy forwards the connections with io.Copy in both directions.
+func copyProxy(l net.Listener, forward string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			d, err := net.Dial("tcp", forward)
+			if err != nil {
+				return
+			}
+			defer d.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				io.Copy(c, d)
+				c.(*net.TCPConn).CloseWrite()
+			}()
+			io.Copy(d, c)
+			d.(*net.TCPConn).CloseWrite()
+			<-done
+		}()
+	}
+}
+
+// bench sends the data through a proxy subprocess into a discarding sink, and reports the proxy CPU usage.
+func bench(mode string) error {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+	go func() {
+		for {
+			c, err := sink.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+
+	args := []string{"--role", "proxy", "--forward", sink.Addr().String(), "--mode", mode}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	addr = addr[:len(addr)-1]
+
+	start := time.Now()
+	errs := make(chan error, *conns)
+	wg := sync.WaitGroup{}
+	for range *conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- send(addr)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+	var all []error
+	for err := range errs {
+		all = append(all, err)
+	}
+	if err := errors.Join(all...); err != nil {
+		return err
+	}
+
+	ru := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	total := float64(*size) * float64(*conns)
+	fmt.Printf("%-10s %9.0fMB/s %10s %12s\n", mode,
+		total/elapsed.Seconds()/1e6, cpu.Round(time.Millisecond),
+		time.Duration(float64(cpu)/(total/(1<<30))).Round(time.Millisecond))
+	return nil
+}
+
+// send writes the data through the proxy and waits for the sink to close the connection.
+func send(addr string) error {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	buf := make([]byte, 256*1024)
+	for sent := int64(0); sent < *size; sent += int64(len(buf)) {
+		if _, err := c.Write(buf); err != nil {
+			return err
+		}
+	}
+	c.(*net.TCPConn).CloseWrite()
+	_, err = io.Copy(io.Discard, c)
+	return err
+}